@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+
+	"github.com/pentops/prototools/protoprint"
+	"github.com/pentops/prototools/protosrc"
+	"github.com/pentops/runner/commander"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+var Version = "0.0.0"
+
+func main() {
+	cmdGroup := commander.NewCommandSet()
+
+	cmdGroup.Add("fmt", commander.NewCommand(runFmt), commander.CommandWithDescription("Format the proto files of a buf module"))
+
+	cmdGroup.RunMain("prototools", Version)
+}
+
+type fmtConfig struct {
+	Dir string `flag:"dir" default:"." description:"The buf module directory, containing buf.lock"`
+
+	Write    bool `flag:"w" description:"Rewrite files which are not formatted"`
+	Diff     bool `flag:"d" description:"Print a unified diff for files which are not formatted"`
+	List     bool `flag:"l" description:"List files which are not formatted, the default when no other mode is set"`
+	ExitCode bool `flag:"exit-code" description:"Exit with an error when any file is not formatted"`
+
+	Lenient bool `flag:"lenient" description:"Print options whose extension can't be resolved from their source, rather than failing"`
+}
+
+func runFmt(ctx context.Context, cfg fmtConfig) error {
+	return fmtModule(ctx, cfg, os.Stdout)
+}
+
+func fmtModule(ctx context.Context, cfg fmtConfig, stdout io.Writer) error {
+	if !cfg.Write && !cfg.Diff {
+		cfg.List = true
+	}
+
+	rootFS := os.DirFS(cfg.Dir)
+	descriptors, err := protosrc.ReadImageFromSourceDir(ctx, rootFS, ".")
+	if err != nil {
+		return err
+	}
+
+	policy, err := protoprint.LoadPolicy(rootFS, ".")
+	if err != nil {
+		return err
+	}
+
+	changes := &changeWriter{
+		source: rootFS,
+	}
+	if err := protoprint.PrintReflect(ctx, changes, descriptors, protoprint.Options{
+		Policy:  policy,
+		Lenient: cfg.Lenient,
+		Source:  rootFS,
+	}); err != nil {
+		return err
+	}
+
+	sort.Slice(changes.changed, func(i, j int) bool {
+		return changes.changed[i].filename < changes.changed[j].filename
+	})
+
+	writer := protoprint.NewDirWriter(cfg.Dir)
+
+	for _, change := range changes.changed {
+		if cfg.List {
+			fmt.Fprintln(stdout, change.filename)
+		}
+
+		if cfg.Diff {
+			diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+				A:        difflib.SplitLines(string(change.original)),
+				B:        difflib.SplitLines(string(change.formatted)),
+				FromFile: "a/" + change.filename,
+				ToFile:   "b/" + change.filename,
+				Context:  3,
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(stdout, diff)
+		}
+
+		if cfg.Write {
+			if err := writer.PutFile(ctx, change.filename, change.formatted); err != nil {
+				return err
+			}
+		}
+	}
+
+	if cfg.ExitCode && len(changes.changed) > 0 {
+		return fmt.Errorf("%d files are not formatted", len(changes.changed))
+	}
+
+	return nil
+}
+
+type changedFile struct {
+	filename  string
+	original  []byte
+	formatted []byte
+}
+
+// changeWriter is a FileWriter which records the files which differ from the
+// source.
+type changeWriter struct {
+	source  fs.FS
+	changed []changedFile
+}
+
+func (cw *changeWriter) PutFile(ctx context.Context, filename string, data []byte) error {
+	original, err := fs.ReadFile(cw.source, filename)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(original, data) {
+		return nil
+	}
+
+	cw.changed = append(cw.changed, changedFile{
+		filename:  filename,
+		original:  original,
+		formatted: data,
+	})
+	return nil
+}
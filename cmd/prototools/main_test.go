@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const formattedProto = `syntax = "proto3";
+
+package test.v1;
+
+message Foo {
+  string name = 1;
+}
+`
+
+const unformattedProto = `syntax = "proto3";
+package test.v1;
+message Foo {
+    string name = 1;
+}
+`
+
+func writeModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files["buf.lock"] = "version: v1\n"
+	for name, content := range files {
+		fullPath := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestFmt(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("list", func(t *testing.T) {
+		dir := writeModule(t, map[string]string{
+			"test/v1/good.proto": formattedProto,
+			"test/v1/bad.proto":  strings.Replace(unformattedProto, "Foo", "Bar", 1),
+		})
+
+		out := &bytes.Buffer{}
+		if err := fmtModule(ctx, fmtConfig{Dir: dir}, out); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.String(); got != "test/v1/bad.proto\n" {
+			t.Errorf("unexpected list output %q", got)
+		}
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		dir := writeModule(t, map[string]string{
+			"test/v1/bad.proto": unformattedProto,
+		})
+
+		out := &bytes.Buffer{}
+		if err := fmtModule(ctx, fmtConfig{Dir: dir, Diff: true}, out); err != nil {
+			t.Fatal(err)
+		}
+		diff := out.String()
+		for _, want := range []string{
+			"--- a/test/v1/bad.proto\n",
+			"+++ b/test/v1/bad.proto\n",
+			"-    string name = 1;\n",
+			"+  string name = 1;\n",
+		} {
+			if !strings.Contains(diff, want) {
+				t.Errorf("diff missing %q:\n%s", want, diff)
+			}
+		}
+	})
+
+	t.Run("write", func(t *testing.T) {
+		dir := writeModule(t, map[string]string{
+			"test/v1/bad.proto": unformattedProto,
+		})
+
+		if err := fmtModule(ctx, fmtConfig{Dir: dir, Write: true}, &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+		written, err := os.ReadFile(filepath.Join(dir, "test/v1/bad.proto"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(written) != formattedProto {
+			t.Errorf("unexpected written file:\n%s", written)
+		}
+
+		// Once written, nothing changes
+		if err := fmtModule(ctx, fmtConfig{Dir: dir, ExitCode: true}, &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("exit code", func(t *testing.T) {
+		dir := writeModule(t, map[string]string{
+			"test/v1/bad.proto": unformattedProto,
+		})
+
+		err := fmtModule(ctx, fmtConfig{Dir: dir, ExitCode: true}, &bytes.Buffer{})
+		if err == nil {
+			t.Fatal("expected an error for unformatted files")
+		}
+	})
+
+	t.Run("lenient", func(t *testing.T) {
+		dir := writeModule(t, map[string]string{
+			"test/v1/good.proto": formattedProto,
+		})
+
+		if err := fmtModule(ctx, fmtConfig{Dir: dir, ExitCode: true, Lenient: true}, &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("policy", func(t *testing.T) {
+		proto := strings.Join([]string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "google/protobuf/descriptor.proto";`,
+			``,
+			`message Foo {`,
+			`  option (rule) = {name: "foo"};`,
+			`}`,
+			``,
+			`message Rule {`,
+			`  string name = 1;`,
+			`}`,
+			``,
+			`extend google.protobuf.MessageOptions {`,
+			`  Rule rule = 50000;`,
+			`}`,
+			``,
+		}, "\n")
+
+		dir := writeModule(t, map[string]string{
+			"test/v1/test.proto": proto,
+		})
+		if err := fmtModule(ctx, fmtConfig{Dir: dir, ExitCode: true}, &bytes.Buffer{}); err == nil {
+			t.Fatal("expected the option to be simplified without a policy")
+		}
+
+		dir = writeModule(t, map[string]string{
+			"test/v1/test.proto": proto,
+			"protoprint.yaml":    "options:\n  test.v1.rule:\n    aggregate: true\n",
+		})
+		if err := fmtModule(ctx, fmtConfig{Dir: dir, ExitCode: true}, &bytes.Buffer{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
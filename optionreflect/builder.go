@@ -2,18 +2,30 @@ package optionreflect
 
 import (
 	"fmt"
+	"math"
 	"sort"
+	"sync"
 
 	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
-	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/descriptorpb"
 	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 type Builder struct {
+	// Lenient keeps options for extensions which are not known to the builder
+	// as UnresolvedOption values, rather than failing.
+	Lenient bool
+
 	exts map[protoreflect.FullName]map[protoreflect.FieldNumber]protoreflect.ExtensionDescriptor
+
+	// locations are the source locations of each file seen, indexed once
+	// rather than for each element. The mutex guards the map, each file is
+	// indexed outside it.
+	locationsMu sync.Mutex
+	locations   map[protoreflect.FileDescriptor]*fileLocations
 }
 
 func NewBuilder(exts []protoreflect.ExtensionDescriptor) *Builder {
@@ -34,6 +46,85 @@ func NewBuilder(exts []protoreflect.ExtensionDescriptor) *Builder {
 	}
 }
 
+// FindExtensionByName implements protoregistry.ExtensionTypeResolver
+func (fb *Builder) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	if fb == nil {
+		return nil, protoregistry.NotFound
+	}
+	for _, msgExt := range fb.exts {
+		for _, xt := range msgExt {
+			if xt.FullName() == field {
+				return extensionType(xt), nil
+			}
+		}
+	}
+	return nil, protoregistry.NotFound
+}
+
+// FindExtensionByNumber implements protoregistry.ExtensionTypeResolver
+func (fb *Builder) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	xt, err := fb.findExtension(message, field)
+	if err != nil {
+		return nil, protoregistry.NotFound
+	}
+	return extensionType(xt), nil
+}
+
+func extensionType(xt protoreflect.ExtensionDescriptor) protoreflect.ExtensionType {
+	if xtd, ok := xt.(protoreflect.ExtensionTypeDescriptor); ok {
+		return xtd.Type()
+	}
+	return dynamicpb.NewExtensionType(xt)
+}
+
+// FileExtensions returns all extensions declared in the file, including those
+// declared in the scope of a message.
+func FileExtensions(file protoreflect.FileDescriptor) []protoreflect.ExtensionDescriptor {
+	exts := make([]protoreflect.ExtensionDescriptor, 0)
+	for idx := 0; idx < file.Extensions().Len(); idx++ {
+		exts = append(exts, file.Extensions().Get(idx))
+	}
+	return append(exts, messageExtensions(file.Messages())...)
+}
+
+// ImportedExtensions returns the extensions declared in the files, and in all
+// of the files they import, transitively.
+func ImportedExtensions(files ...protoreflect.FileDescriptor) []protoreflect.ExtensionDescriptor {
+	exts := make([]protoreflect.ExtensionDescriptor, 0)
+	seen := map[string]struct{}{}
+
+	var walk func(file protoreflect.FileDescriptor)
+	walk = func(file protoreflect.FileDescriptor) {
+		if _, ok := seen[file.Path()]; ok {
+			return
+		}
+		seen[file.Path()] = struct{}{}
+		exts = append(exts, FileExtensions(file)...)
+
+		imports := file.Imports()
+		for idx := 0; idx < imports.Len(); idx++ {
+			walk(imports.Get(idx).FileDescriptor)
+		}
+	}
+
+	for _, file := range files {
+		walk(file)
+	}
+	return exts
+}
+
+func messageExtensions(messages protoreflect.MessageDescriptors) []protoreflect.ExtensionDescriptor {
+	exts := make([]protoreflect.ExtensionDescriptor, 0)
+	for idx := 0; idx < messages.Len(); idx++ {
+		msg := messages.Get(idx)
+		for extIdx := 0; extIdx < msg.Extensions().Len(); extIdx++ {
+			exts = append(exts, msg.Extensions().Get(extIdx))
+		}
+		exts = append(exts, messageExtensions(msg.Messages())...)
+	}
+	return exts
+}
+
 func (fb *Builder) findExtension(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionDescriptor, error) {
 	if fb == nil {
 		return nil, fmt.Errorf("builder is nil")
@@ -80,46 +171,73 @@ func isPrefix(prefix, path []int32) bool {
 
 func (fb *Builder) OptionsFor(parent protoreflect.Descriptor) ([]*OptionDefinition, error) {
 
-	srcReflect := parent.Options().ProtoReflect()
-	options := make([]*OptionDefinition, 0)
-
 	// The reflection PB doesn't seem to give a way to get the source location
 	// of the place the option was defined. This filters down all of the
 	// locations in the parent object to the 'option' ones (7). Each field of
 	// the option is then its own location.
-	parentFile := parent.ParentFile()
-	sourceLoc := protodesc.ToFileDescriptorProto(parentFile).SourceCodeInfo
+	parentRoot := parent.ParentFile().SourceLocations().ByDescriptor(parent)
+	// options are at different indexes depending on the wrapper type.
+
+	var optionFieldNumberInParent int32
+
+	// field 7 of the Message type is the options field
+	// see google/protobuf/descriptor.proto
+	switch parent.(type) {
+	case protoreflect.FileDescriptor:
+		optionFieldNumberInParent = 8
+	case protoreflect.MessageDescriptor:
+		optionFieldNumberInParent = 7
+	case protoreflect.FieldDescriptor:
+		optionFieldNumberInParent = 8
+	case protoreflect.MethodDescriptor:
+		optionFieldNumberInParent = 4
+	case protoreflect.ServiceDescriptor:
+		optionFieldNumberInParent = 3
+	case protoreflect.EnumDescriptor:
+		optionFieldNumberInParent = 3
+	case protoreflect.EnumValueDescriptor:
+		optionFieldNumberInParent = 3
+	case protoreflect.OneofDescriptor:
+		optionFieldNumberInParent = 2
+	default:
+		return nil, fmt.Errorf("unsupported parent type %T", parent)
+	}
 
-	var optionsLocs []*descriptorpb.SourceCodeInfo_Location
-	if sourceLoc != nil {
-		parentRoot := parentFile.SourceLocations().ByDescriptor(parent)
-		// options are at different indexes depending on the wrapper type.
-
-		var optionFieldNumberInParent int32
-
-		// field 7 of the Message type is the options field
-		// see google/protobuf/descriptor.proto
-		switch parent.(type) {
-		case protoreflect.MessageDescriptor:
-			optionFieldNumberInParent = 7
-		case protoreflect.FieldDescriptor:
-			optionFieldNumberInParent = 8
-		case protoreflect.MethodDescriptor:
-			optionFieldNumberInParent = 4
-		case protoreflect.ServiceDescriptor:
-			optionFieldNumberInParent = 3
-		case protoreflect.EnumDescriptor:
-			optionFieldNumberInParent = 3
-		case protoreflect.EnumValueDescriptor:
-			optionFieldNumberInParent = 3
-		case protoreflect.OneofDescriptor:
-			optionFieldNumberInParent = 2
-		default:
-			return nil, fmt.Errorf("unsupported parent type %T", parent)
-		}
+	parentPath := make([]int32, len(parentRoot.Path), len(parentRoot.Path)+1)
+	copy(parentPath, parentRoot.Path)
+	parentPath = append(parentPath, optionFieldNumberInParent)
+
+	return fb.optionsAt(parent, parent.Options(), parentPath, parentRoot)
+}
+
+// ExtensionRangeOptionsFor returns the options of the message's extension
+// range at the index, which are set on the range rather than a descriptor. The
+// context of the options is the message.
+func (fb *Builder) ExtensionRangeOptionsFor(msg protoreflect.MessageDescriptor, idx int) ([]*OptionDefinition, error) {
+	msgRoot := msg.ParentFile().SourceLocations().ByDescriptor(msg)
 
-		parentPath := append(parentRoot.Path, optionFieldNumberInParent)
-		optionsLocs = subLocations(sourceLoc.Location, parentPath)
+	// field 5 of DescriptorProto is extension_range, field 3 of ExtensionRange
+	// is its options.
+	rangePath := make([]int32, len(msgRoot.Path), len(msgRoot.Path)+3)
+	copy(rangePath, msgRoot.Path)
+	rangePath = append(rangePath, 5, int32(idx))
+	rangeLocation := msg.ParentFile().SourceLocations().ByPath(rangePath)
+
+	return fb.optionsAt(msg, msg.ExtensionRangeOptions(idx), append(rangePath, 3), rangeLocation)
+}
+
+// optionsAt builds the definitions of the options message, which is at the
+// path in the source of the context's file.
+func (fb *Builder) optionsAt(context protoreflect.Descriptor, optionsMsg protoreflect.ProtoMessage, optionsPath []int32, parentLocation protoreflect.SourceLocation) ([]*OptionDefinition, error) {
+	options := make([]*OptionDefinition, 0)
+	if optionsMsg == nil {
+		return options, nil
+	}
+	srcReflect := optionsMsg.ProtoReflect()
+
+	var optionsLocs []*descriptorpb.SourceCodeInfo_Location
+	if fileLocs := fb.fileLocations(context.ParentFile()); fileLocs != nil {
+		optionsLocs = fileLocs.under(optionsPath)
 	}
 
 	type foundOption struct {
@@ -144,63 +262,85 @@ func (fb *Builder) OptionsFor(parent protoreflect.Descriptor) ([]*OptionDefiniti
 		return true
 	})
 
+	unresolved := make([]*UnresolvedOption, 0)
+
 	unknown := srcReflect.GetUnknown()
-	if unknown != nil {
+	if len(unknown) > 0 {
+		parentName := srcReflect.Descriptor().FullName()
+
+		// Check each field first, to report the specific missing extension,
+		// or in lenient mode to set aside the fields which can't be decoded.
+		resolved := make([]byte, 0, len(unknown))
+		unresolvedByNumber := map[protoreflect.FieldNumber]*UnresolvedOption{}
 		b := unknown
 		for len(b) > 0 {
-			fNumber, fType, n := protowire.ConsumeTag(b)
-			b = b[n:]
-
-			if fType != protowire.BytesType {
-				return nil, fmt.Errorf("unknown field type %d", fType)
+			fNumber, _, n := protowire.ConsumeField(b)
+			if n < 0 {
+				return nil, fmt.Errorf("failed to parse unknown option: %w", protowire.ParseError(n))
 			}
-
-			raw, n := protowire.ConsumeBytes(b)
+			field := b[:n]
 			b = b[n:]
-			parentName := srcReflect.Descriptor().FullName()
 
-			serviceExt, err := fb.findExtension(parentName, fNumber)
-			if err != nil {
-				return nil, fmt.Errorf("failed to find extension: %w", err)
+			if _, err := fb.findExtension(parentName, fNumber); err != nil {
+				if fb == nil || !fb.Lenient {
+					return nil, fmt.Errorf("failed to find extension %d of %s: %w", fNumber, parentName, err)
+				}
+				opt, ok := unresolvedByNumber[fNumber]
+				if !ok {
+					opt = &UnresolvedOption{
+						Number:    fNumber,
+						Locations: statementLocations(optionsLocs, fNumber),
+					}
+					unresolvedByNumber[fNumber] = opt
+					unresolved = append(unresolved, opt)
+				}
+				opt.Raw = append(opt.Raw, field...)
+				continue
 			}
+			resolved = append(resolved, field...)
+		}
 
-			if serviceExt.Number() != fNumber {
-				return nil, fmt.Errorf("extension number mismatch")
-			}
-
-			// TODO: This assumes all extensions are messages
-			extMsg := serviceExt.Message()
-
-			dynamicExt := dynamicpb.NewMessage(extMsg)
-			if err := proto.Unmarshal(raw, dynamicExt); err != nil {
-				return nil, fmt.Errorf("failed to unmarshal extension: %w", err)
-			}
+		// Unmarshalling into a fresh options message, resolving with the
+		// builder, decodes each wire type to its value, and merges repeated
+		// extensions, packed or not, into a single list.
+		decoded := dynamicpb.NewMessage(srcReflect.Descriptor())
+		if err := (proto.UnmarshalOptions{Resolver: fb}).Unmarshal(resolved, decoded); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal extensions: %w", err)
+		}
 
+		decoded.Range(func(desc protoreflect.FieldDescriptor, val protoreflect.Value) bool {
 			foundOptions = append(foundOptions, foundOption{
-				optionNumber: serviceExt.Number(),
-				fieldDesc:    serviceExt,
-				fieldVal:     protoreflect.ValueOfMessage(dynamicExt),
+				optionNumber: desc.Number(),
+				fieldDesc:    desc,
+				fieldVal:     val,
 			})
-
-		}
+			return true
+		})
 	}
 
-	parentLocation := parent.ParentFile().SourceLocations().ByDescriptor(parent)
-
 	for _, desc := range foundOptions {
 
-		sourceLoc := buildSourceLocation(optionsLocs, parentLocation, desc.fieldDesc)
+		sourceLoc := buildSourceLocation(optionsLocs, parentLocation, desc.optionNumber)
 		built := &OptionDefinition{
-			Context:        parent,
+			Context:        context,
 			Desc:           desc.fieldDesc,
 			RootType:       desc.fieldDesc,
 			Value:          desc.fieldVal,
 			SourceLocation: sourceLoc,
+			Statements:     buildStatements(optionsLocs, parentLocation, desc.optionNumber),
 		}
 
 		options = append(options, built)
 	}
 
+	for _, opt := range unresolved {
+		options = append(options, &OptionDefinition{
+			Context:        context,
+			SourceLocation: buildSourceLocation(optionsLocs, parentLocation, opt.Number),
+			Unresolved:     opt,
+		})
+	}
+
 	sort.Sort(optionsByLocation(options))
 	return options, nil
 
@@ -214,14 +354,23 @@ func (o optionsByLocation) Len() int {
 
 func (o optionsByLocation) Less(i, j int) bool {
 	if o[i].SourceLocation == nil || o[j].SourceLocation == nil {
-		return o[i].Desc.Index() < o[j].Desc.Index()
+		return descriptorOrder(o[i]) < descriptorOrder(o[j])
 	}
 	if o[i].SourceLocation.StartLine == 0 || o[j].SourceLocation.StartLine == 0 {
-		return o[i].Desc.Index() < o[j].Desc.Index()
+		return descriptorOrder(o[i]) < descriptorOrder(o[j])
 	}
 	return o[i].SourceLocation.StartLine < o[j].SourceLocation.StartLine
 }
 
+// descriptorOrder orders options without a source location, unresolved options
+// have no descriptor so follow the others by number.
+func descriptorOrder(opt *OptionDefinition) int {
+	if opt.Unresolved != nil {
+		return math.MaxInt32 + int(opt.Unresolved.Number)
+	}
+	return opt.Desc.Index()
+}
+
 func (o optionsByLocation) Swap(i, j int) {
 	o[i], o[j] = o[j], o[i]
 }
@@ -1,14 +1,21 @@
 package optionreflect
 
 import (
+	"context"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/bufbuild/protocompile"
 	"github.com/stretchr/testify/assert"
 	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -94,7 +101,10 @@ func TestParse(t *testing.T) {
 		assert.Len(t, opt.SubPath, 0)
 		assert.Equal(t, "(google.api.http)", opt.FullType())
 
-		root := WalkOptionField(opt.Desc, opt.Value)
+		root, err := WalkOptionField(opt.Desc, opt.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
 
 		assert.Equal(t, FieldTypeMessage, root.FieldType)
 		assert.Len(t, root.Children, 2)
@@ -125,3 +135,383 @@ func TestParse(t *testing.T) {
 	}
 
 }
+
+func TestWalkMessageMap(t *testing.T) {
+	input := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Syntax:  proto.String("proto3"),
+		Package: proto.String("test.v1"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Opt"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:     proto.String("entries"),
+				Number:   proto.Int32(1),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+				TypeName: proto.String(".test.v1.Opt.EntriesEntry"),
+			}, {
+				Name:     proto.String("numbers"),
+				Number:   proto.Int32(2),
+				Label:    descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+				Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+				TypeName: proto.String(".test.v1.Opt.NumbersEntry"),
+			}},
+			NestedType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("EntriesEntry"),
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name:   proto.String("key"),
+					Number: proto.Int32(1),
+					Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				}, {
+					Name:     proto.String("value"),
+					Number:   proto.Int32(2),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+					TypeName: proto.String(".test.v1.Inner"),
+				}},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}, {
+				Name: proto.String("NumbersEntry"),
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name:   proto.String("key"),
+					Number: proto.Int32(1),
+					Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:   descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(),
+				}, {
+					Name:   proto.String("value"),
+					Number: proto.Int32(2),
+					Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+					Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				}},
+				Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+			}},
+		}, {
+			Name: proto.String("Inner"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:   proto.String("name"),
+				Number: proto.Int32(1),
+				Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			}},
+		}},
+	}
+
+	testFile, err := protodesc.NewFile(input, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	optDesc := testFile.Messages().ByName("Opt")
+	innerDesc := testFile.Messages().ByName("Inner")
+
+	opt := dynamicpb.NewMessage(optDesc)
+	entries := opt.Mutable(optDesc.Fields().ByName("entries")).Map()
+	for _, key := range []string{"b", "c", "a"} {
+		inner := dynamicpb.NewMessage(innerDesc)
+		inner.Set(innerDesc.Fields().ByName("name"), protoreflect.ValueOfString("name-"+key))
+		entries.Set(protoreflect.ValueOfString(key).MapKey(), protoreflect.ValueOfMessage(inner))
+	}
+	numbers := opt.Mutable(optDesc.Fields().ByName("numbers")).Map()
+	for _, key := range []int32{10, -1, 2} {
+		numbers.Set(protoreflect.ValueOfInt32(key).MapKey(), protoreflect.ValueOfString("v"))
+	}
+
+	walked, err := optionWalker{}.message(optDesc.Fields().ByName("entries"), opt, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, walked.Children, 2) {
+		t.FailNow()
+	}
+
+	entriesField := walked.Children[0]
+	assert.Equal(t, FieldTypeArray, entriesField.FieldType)
+	if !assert.Len(t, entriesField.Children, 3) {
+		t.FailNow()
+	}
+	for idx, key := range []string{"a", "b", "c"} {
+		entry := entriesField.Children[idx]
+		assert.Equal(t, FieldTypeMessage, entry.FieldType)
+		assert.Equal(t, "key", entry.Children[0].Key)
+		assert.Equal(t, `"`+key+`"`, entry.Children[0].ScalarValue)
+		assert.Equal(t, "value", entry.Children[1].Key)
+		assert.Equal(t, FieldTypeMessage, entry.Children[1].FieldType)
+		assert.Equal(t, `"name-`+key+`"`, entry.Children[1].Children[0].ScalarValue)
+	}
+
+	numbersField := walked.Children[1]
+	if !assert.Len(t, numbersField.Children, 3) {
+		t.FailNow()
+	}
+	for idx, key := range []string{"-1", "2", "10"} {
+		assert.Equal(t, key, numbersField.Children[idx].Children[0].ScalarValue)
+	}
+}
+
+func TestUnknownScalarExtensions(t *testing.T) {
+	extension := func(name string, number int32, label descriptorpb.FieldDescriptorProto_Label, fieldType descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    label.Enum(),
+			Type:     fieldType.Enum(),
+			Extendee: proto.String(".google.protobuf.MessageOptions"),
+		}
+	}
+
+	optional := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+	repeated := descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+
+	level := extension("level", 50002, optional, descriptorpb.FieldDescriptorProto_TYPE_ENUM)
+	level.TypeName = proto.String(".test.v1.Level")
+
+	input := &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("test.proto"),
+		Syntax:     proto.String("proto2"),
+		Package:    proto.String("test.v1"),
+		Dependency: []string{"google/protobuf/descriptor.proto"},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Level"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{{
+				Name:   proto.String("LOW"),
+				Number: proto.Int32(0),
+			}, {
+				Name:   proto.String("HIGH"),
+				Number: proto.Int32(1),
+			}},
+		}},
+		Extension: []*descriptorpb.FieldDescriptorProto{
+			extension("sensitive", 50001, optional, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+			level,
+			extension("f32", 50003, optional, descriptorpb.FieldDescriptorProto_TYPE_FIXED32),
+			extension("f64", 50004, optional, descriptorpb.FieldDescriptorProto_TYPE_SFIXED64),
+			extension("nums", 50005, repeated, descriptorpb.FieldDescriptorProto_TYPE_INT32),
+			extension("label", 50006, optional, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+		},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name:    proto.String("Test"),
+			Options: &descriptorpb.MessageOptions{},
+		}},
+	}
+
+	// The extensions are not registered, so are stored as unknown fields.
+	var raw []byte
+	raw = protowire.AppendTag(raw, 50001, protowire.VarintType)
+	raw = protowire.AppendVarint(raw, 1)
+	raw = protowire.AppendTag(raw, 50002, protowire.VarintType)
+	raw = protowire.AppendVarint(raw, 1)
+	raw = protowire.AppendTag(raw, 50003, protowire.Fixed32Type)
+	raw = protowire.AppendFixed32(raw, 32)
+	raw = protowire.AppendTag(raw, 50004, protowire.Fixed64Type)
+	raw = protowire.AppendFixed64(raw, uint64(0xffffffffffffffc0)) // -64
+	raw = protowire.AppendTag(raw, 50005, protowire.BytesType)
+	raw = protowire.AppendBytes(raw, protowire.AppendVarint(protowire.AppendVarint(nil, 1), 2))
+	raw = protowire.AppendTag(raw, 50006, protowire.BytesType)
+	raw = protowire.AppendString(raw, "value")
+	raw = protowire.AppendTag(raw, 50005, protowire.VarintType)
+	raw = protowire.AppendVarint(raw, 3)
+	input.MessageType[0].Options.ProtoReflect().SetUnknown(raw)
+
+	testFile, err := protodesc.NewFile(input, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ob := NewBuilder(FileExtensions(testFile))
+
+	opts, err := ob.OptionsFor(testFile.Messages().ByName("Test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string]string{}
+	for _, opt := range opts {
+		items := []*OptionDefinition{opt}
+		if opt.Desc.IsList() {
+			items = opt.ListItems()
+		}
+		for _, item := range items {
+			walked, err := WalkOptionItem(item.Desc, item.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			values[item.FullType()] += walked.ScalarValue + ";"
+		}
+	}
+
+	assert.Equal(t, map[string]string{
+		"(test.v1.sensitive)": "true;",
+		"(test.v1.level)":     "HIGH;",
+		"(test.v1.f32)":       "32;",
+		"(test.v1.f64)":       "-64;",
+		"(test.v1.nums)":      "1;2;3;",
+		"(test.v1.label)":     `"value";`,
+	}, values)
+
+	t.Run("missing extension", func(t *testing.T) {
+		_, err := NewBuilder(nil).OptionsFor(testFile.Messages().ByName("Test"))
+		assert.ErrorContains(t, err, "50001")
+	})
+}
+
+func compileSource(tb testing.TB, src string) protoreflect.FileDescriptor {
+	tb.Helper()
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(&protocompile.SourceResolver{
+			Accessor: protocompile.SourceAccessorFromMap(map[string]string{"test.proto": src}),
+		}),
+		SourceInfoMode: protocompile.SourceInfoExtraComments | protocompile.SourceInfoExtraOptionLocations,
+	}
+	compiled, err := compiler.Compile(context.Background(), "test.proto")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return compiled[0]
+}
+
+func TestLocationIndex(t *testing.T) {
+	file := compileSource(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		`package test.v1;`,
+		`option go_package = "test/v1";`,
+		`message Foo {`,
+		`  option deprecated = true;`,
+		`  string id = 1 [deprecated = true, json_name = "ID"];`,
+		`  message Bar { int32 n = 1 [deprecated = true]; }`,
+		`}`,
+	}, "\n"))
+
+	locs := protodesc.ToFileDescriptorProto(file).SourceCodeInfo.Location
+	idx := newLocationIndex(protodesc.ToFileDescriptorProto(file).SourceCodeInfo)
+
+	for _, loc := range locs {
+		for end := 0; end <= len(loc.Path); end++ {
+			path := loc.Path[:end]
+			assert.Equal(t, subLocations(locs, path), idx.under(path), "path %v", path)
+		}
+	}
+	assert.Empty(t, idx.under([]int32{4, 5}))
+}
+
+// largeFile has a message with thousands of fields, each with options.
+func largeFile(tb testing.TB, fields int) protoreflect.FileDescriptor {
+	lines := []string{
+		`syntax = "proto3";`,
+		`package test.v1;`,
+		`message Large {`,
+		`  option deprecated = true;`,
+	}
+	for num := 1; num <= fields; num++ {
+		lines = append(lines, fmt.Sprintf(`  string field_%d = %d [deprecated = true, json_name = "f%d"];`, num, num, num))
+	}
+	lines = append(lines, `}`)
+	return compileSource(tb, strings.Join(lines, "\n"))
+}
+
+func BenchmarkOptionsFor(b *testing.B) {
+	file := largeFile(b, 2000)
+	fields := file.Messages().Get(0).Fields()
+
+	b.Run("shared", func(b *testing.B) {
+		// One builder for the file indexes its locations once.
+		for i := 0; i < b.N; i++ {
+			ob := NewBuilder(nil)
+			for idx := 0; idx < fields.Len(); idx++ {
+				if _, err := ob.OptionsFor(fields.Get(idx)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("per element", func(b *testing.B) {
+		// A builder for each element re-reads the file's locations every time,
+		// as every call used to.
+		for i := 0; i < b.N; i++ {
+			for idx := 0; idx < fields.Len(); idx++ {
+				if _, err := NewBuilder(nil).OptionsFor(fields.Get(idx)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func BenchmarkLocations(b *testing.B) {
+	file := largeFile(b, 2000)
+	info := protodesc.ToFileDescriptorProto(file).SourceCodeInfo
+	fields := file.Messages().Get(0).Fields()
+
+	// The options of each field, at message_type[0].field[idx].options
+	paths := make([][]int32, fields.Len())
+	for idx := range paths {
+		paths[idx] = []int32{4, 0, 2, int32(idx), 8}
+	}
+
+	b.Run("scan", func(b *testing.B) {
+		// Every element scans all of the file's locations.
+		for i := 0; i < b.N; i++ {
+			for _, path := range paths {
+				subLocations(info.Location, path)
+			}
+		}
+	})
+
+	b.Run("index", func(b *testing.B) {
+		// The file is indexed once, each element follows its path.
+		for i := 0; i < b.N; i++ {
+			idx := newLocationIndex(info)
+			for _, path := range paths {
+				idx.under(path)
+			}
+		}
+	})
+}
+
+func TestWalkGroupValue(t *testing.T) {
+	file := compileSource(t, strings.Join([]string{
+		`syntax = "proto2";`,
+		`package test.v1;`,
+		`import "google/protobuf/descriptor.proto";`,
+		`extend google.protobuf.MessageOptions {`,
+		`  optional group Rule = 50000 {`,
+		`    optional string name = 1;`,
+		`    optional group Inner = 2 {`,
+		`      optional int32 count = 1;`,
+		`    }`,
+		`  }`,
+		`}`,
+		`message Foo {`,
+		`  option (rule) = {name: "foo" Inner: {count: 1}};`,
+		`}`,
+	}, "\n"))
+
+	opts, err := NewBuilder(FileExtensions(file)).OptionsFor(file.Messages().ByName("Foo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !assert.Len(t, opts, 1) {
+		t.FailNow()
+	}
+
+	walked, err := opts[0].Walk()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Groups are walked as messages, keyed by the group's type name in
+	// message literals.
+	assert.Equal(t, FieldTypeMessage, walked.FieldType)
+	if !assert.Len(t, walked.Children, 2) {
+		t.FailNow()
+	}
+	assert.Equal(t, "name", walked.Children[0].Key)
+	assert.Equal(t, `"foo"`, walked.Children[0].ScalarValue)
+	inner := walked.Children[1]
+	assert.Equal(t, "Inner", inner.Key)
+	assert.Equal(t, FieldTypeMessage, inner.FieldType)
+	if assert.Len(t, inner.Children, 1) {
+		assert.Equal(t, "count", inner.Children[0].Key)
+		assert.Equal(t, "1", inner.Children[0].ScalarValue)
+	}
+}
@@ -0,0 +1,182 @@
+package optionreflect
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// FileEdition returns the edition of the file. Proto2 and Proto3 files return
+// their legacy editions, EDITION_PROTO2 and EDITION_PROTO3.
+func FileEdition(file protoreflect.FileDescriptor) descriptorpb.Edition {
+	switch file.Syntax() {
+	case protoreflect.Proto2:
+		return descriptorpb.Edition_EDITION_PROTO2
+	case protoreflect.Proto3:
+		return descriptorpb.Edition_EDITION_PROTO3
+	}
+
+	// Both protodesc and protocompile implement this, but it isn't part of
+	// the protoreflect interface.
+	if withEdition, ok := file.(interface{ Edition() int32 }); ok {
+		return descriptorpb.Edition(withEdition.Edition())
+	}
+	return descriptorpb.Edition_EDITION_UNKNOWN
+}
+
+// EditionDefaults returns the features of the edition, as declared in the
+// edition_defaults option of each field of google.protobuf.FeatureSet.
+func EditionDefaults(edition descriptorpb.Edition) (*descriptorpb.FeatureSet, error) {
+	if edition == descriptorpb.Edition_EDITION_UNKNOWN {
+		return nil, fmt.Errorf("unknown edition")
+	}
+
+	defaults := &descriptorpb.FeatureSet{}
+	refl := defaults.ProtoReflect()
+	fields := refl.Descriptor().Fields()
+
+	for idx := 0; idx < fields.Len(); idx++ {
+		field := fields.Get(idx)
+		fieldOptions, ok := field.Options().(*descriptorpb.FieldOptions)
+		if !ok {
+			continue
+		}
+
+		// The defaults apply from their edition onwards, the last one which
+		// is not after the requested edition wins.
+		var value *string
+		var valueEdition descriptorpb.Edition
+		for _, editionDefault := range fieldOptions.GetEditionDefaults() {
+			if editionDefault.GetEdition() > edition || editionDefault.GetEdition() < valueEdition {
+				continue
+			}
+			value = editionDefault.Value
+			valueEdition = editionDefault.GetEdition()
+		}
+		if value == nil {
+			continue
+		}
+
+		switch field.Kind() {
+		case protoreflect.EnumKind:
+			enumValue := field.Enum().Values().ByName(protoreflect.Name(*value))
+			if enumValue == nil {
+				return nil, fmt.Errorf("unknown default %q for feature %s", *value, field.Name())
+			}
+			refl.Set(field, protoreflect.ValueOfEnum(enumValue.Number()))
+		case protoreflect.BoolKind:
+			refl.Set(field, protoreflect.ValueOfBool(*value == "true"))
+		default:
+			return nil, fmt.Errorf("unsupported feature type %s for %s", field.Kind(), field.Name())
+		}
+	}
+
+	return defaults, nil
+}
+
+// DescriptorFeatures returns the features set directly on the descriptor's
+// options, or nil if there are none.
+func DescriptorFeatures(desc protoreflect.Descriptor) (*descriptorpb.FeatureSet, error) {
+	options := desc.Options()
+	if options == nil {
+		return nil, nil
+	}
+	refl := options.ProtoReflect()
+	field := refl.Descriptor().Fields().ByName("features")
+	if field == nil || !refl.Has(field) {
+		return nil, nil
+	}
+
+	val := refl.Get(field).Message().Interface()
+	if features, ok := val.(*descriptorpb.FeatureSet); ok {
+		return features, nil
+	}
+
+	// Options built dynamically have a dynamic feature set
+	raw, err := proto.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	features := &descriptorpb.FeatureSet{}
+	if err := proto.Unmarshal(raw, features); err != nil {
+		return nil, err
+	}
+	return features, nil
+}
+
+// FeatureParent returns the descriptor which the descriptor inherits features
+// from, or nil for files.
+func FeatureParent(desc protoreflect.Descriptor) protoreflect.Descriptor {
+	if field, ok := desc.(protoreflect.FieldDescriptor); ok {
+		// Fields in a oneof inherit from the oneof rather than the message.
+		if oneof := field.ContainingOneof(); oneof != nil && !oneof.IsSynthetic() {
+			return oneof
+		}
+	}
+	return desc.Parent()
+}
+
+// ResolvedFeatures returns the effective features for the descriptor, being
+// the edition defaults of the file, overridden by the features set on each
+// parent and then the descriptor itself. Fields of proto2 and proto3 files
+// have the features implied by their syntax, as protodesc resolves them.
+func ResolvedFeatures(desc protoreflect.Descriptor) (*descriptorpb.FeatureSet, error) {
+	var resolved *descriptorpb.FeatureSet
+
+	if parent := FeatureParent(desc); parent != nil {
+		parentFeatures, err := ResolvedFeatures(parent)
+		if err != nil {
+			return nil, err
+		}
+		resolved = parentFeatures
+	} else {
+		file, ok := desc.(protoreflect.FileDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("descriptor %s has no parent", desc.FullName())
+		}
+		defaults, err := EditionDefaults(FileEdition(file))
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %w", file.Path(), err)
+		}
+		resolved = defaults
+	}
+
+	own, err := DescriptorFeatures(desc)
+	if err != nil {
+		return nil, err
+	}
+	if own != nil {
+		proto.Merge(resolved, own)
+	}
+
+	if field, ok := desc.(protoreflect.FieldDescriptor); ok && field.Syntax() != protoreflect.Editions {
+		legacyFieldFeatures(field, resolved)
+	}
+
+	return resolved, nil
+}
+
+// legacyFieldFeatures sets the features which the syntax of proto2 and proto3
+// fields implies, which editions spell out as features.
+func legacyFieldFeatures(field protoreflect.FieldDescriptor, features *descriptorpb.FeatureSet) {
+	if field.Cardinality() == protoreflect.Required {
+		features.FieldPresence = descriptorpb.FeatureSet_LEGACY_REQUIRED.Enum()
+	}
+	if field.Syntax() == protoreflect.Proto3 && field.HasOptionalKeyword() {
+		features.FieldPresence = descriptorpb.FeatureSet_EXPLICIT.Enum()
+	}
+	if field.Kind() == protoreflect.GroupKind {
+		features.MessageEncoding = descriptorpb.FeatureSet_DELIMITED.Enum()
+	}
+
+	options := field.Options().ProtoReflect()
+	if packed := options.Descriptor().Fields().ByName("packed"); packed != nil && options.Has(packed) {
+		if options.Get(packed).Bool() {
+			features.RepeatedFieldEncoding = descriptorpb.FeatureSet_PACKED.Enum()
+		} else {
+			features.RepeatedFieldEncoding = descriptorpb.FeatureSet_EXPANDED.Enum()
+		}
+	}
+}
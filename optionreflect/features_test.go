@@ -0,0 +1,145 @@
+package optionreflect
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestResolvedFeatures(t *testing.T) {
+
+	input := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("test.proto"),
+		Syntax:  proto.String("editions"),
+		Edition: descriptorpb.Edition_EDITION_2023.Enum(),
+		Package: proto.String("test.v1"),
+		Options: &descriptorpb.FileOptions{
+			Features: &descriptorpb.FeatureSet{
+				FieldPresence: descriptorpb.FeatureSet_IMPLICIT.Enum(),
+			},
+		},
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Test"),
+			Field: []*descriptorpb.FieldDescriptorProto{{
+				Name:   proto.String("implicit"),
+				Number: proto.Int32(1),
+				Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+			}, {
+				Name:   proto.String("explicit"),
+				Number: proto.Int32(2),
+				Type:   descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+				Options: &descriptorpb.FieldOptions{
+					Features: &descriptorpb.FeatureSet{
+						FieldPresence: descriptorpb.FeatureSet_EXPLICIT.Enum(),
+					},
+				},
+			}},
+		}},
+	}
+
+	testFile, err := protodesc.NewFile(input, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, descriptorpb.Edition_EDITION_2023, FileEdition(testFile))
+
+	fields := testFile.Messages().ByName("Test").Fields()
+
+	implicit, err := ResolvedFeatures(fields.ByName("implicit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, descriptorpb.FeatureSet_IMPLICIT, implicit.GetFieldPresence())
+	// from the edition defaults
+	assert.Equal(t, descriptorpb.FeatureSet_OPEN, implicit.GetEnumType())
+
+	explicit, err := ResolvedFeatures(fields.ByName("explicit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, descriptorpb.FeatureSet_EXPLICIT, explicit.GetFieldPresence())
+}
+
+func TestResolvedLegacyFeatures(t *testing.T) {
+	proto2 := compileSource(t, strings.Join([]string{
+		`syntax = "proto2";`,
+		`package test.v1;`,
+		`message Test {`,
+		`  required string id = 1;`,
+		`  repeated int32 packed = 2 [packed = true];`,
+		`  repeated int32 expanded = 3;`,
+		`  optional group Result = 4 {`,
+		`    optional string url = 1;`,
+		`  }`,
+		`}`,
+	}, "\n"))
+	proto3 := compileSource(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		`package test.v1;`,
+		`message Test {`,
+		`  optional string explicit = 1;`,
+		`  string implicit = 2;`,
+		`  repeated int32 packed = 3;`,
+		`  repeated int32 expanded = 4 [packed = false];`,
+		`}`,
+	}, "\n"))
+
+	resolve := func(file protoreflect.FileDescriptor, name protoreflect.Name) *descriptorpb.FeatureSet {
+		t.Helper()
+		features, err := ResolvedFeatures(file.Messages().ByName("Test").Fields().ByName(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return features
+	}
+
+	t.Run("required", func(t *testing.T) {
+		assert.Equal(t, descriptorpb.FeatureSet_LEGACY_REQUIRED, resolve(proto2, "id").GetFieldPresence())
+	})
+
+	t.Run("packed", func(t *testing.T) {
+		assert.Equal(t, descriptorpb.FeatureSet_PACKED, resolve(proto2, "packed").GetRepeatedFieldEncoding())
+		assert.Equal(t, descriptorpb.FeatureSet_EXPANDED, resolve(proto2, "expanded").GetRepeatedFieldEncoding())
+		assert.Equal(t, descriptorpb.FeatureSet_PACKED, resolve(proto3, "packed").GetRepeatedFieldEncoding())
+		assert.Equal(t, descriptorpb.FeatureSet_EXPANDED, resolve(proto3, "expanded").GetRepeatedFieldEncoding())
+	})
+
+	t.Run("proto3 optional", func(t *testing.T) {
+		assert.Equal(t, descriptorpb.FeatureSet_EXPLICIT, resolve(proto3, "explicit").GetFieldPresence())
+		assert.Equal(t, descriptorpb.FeatureSet_IMPLICIT, resolve(proto3, "implicit").GetFieldPresence())
+	})
+
+	t.Run("group", func(t *testing.T) {
+		assert.Equal(t, descriptorpb.FeatureSet_DELIMITED, resolve(proto2, "result").GetMessageEncoding())
+		assert.Equal(t, descriptorpb.FeatureSet_LENGTH_PREFIXED, resolve(proto2, "id").GetMessageEncoding())
+	})
+}
+
+func TestEditionDefaults(t *testing.T) {
+	proto2, err := EditionDefaults(descriptorpb.Edition_EDITION_PROTO2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, descriptorpb.FeatureSet_CLOSED, proto2.GetEnumType())
+	assert.Equal(t, descriptorpb.FeatureSet_EXPANDED, proto2.GetRepeatedFieldEncoding())
+
+	proto3, err := EditionDefaults(descriptorpb.Edition_EDITION_PROTO3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, descriptorpb.FeatureSet_IMPLICIT, proto3.GetFieldPresence())
+
+	edition2023, err := EditionDefaults(descriptorpb.Edition_EDITION_2023)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, descriptorpb.FeatureSet_EXPLICIT, edition2023.GetFieldPresence())
+	assert.Equal(t, descriptorpb.FeatureSet_PACKED, edition2023.GetRepeatedFieldEncoding())
+}
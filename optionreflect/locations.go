@@ -0,0 +1,125 @@
+package optionreflect
+
+import (
+	"sort"
+	"sync"
+
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// locationIndex is a trie of the source locations of a file, by path, so that
+// the locations of one element are found without scanning the whole file.
+type locationIndex struct {
+	children map[int32]*locationIndex
+
+	// locs are the locations at exactly this path, with their position in
+	// the file's source info.
+	locs []indexedLocation
+}
+
+type indexedLocation struct {
+	order int
+	loc   *descriptorpb.SourceCodeInfo_Location
+}
+
+func newLocationIndex(info *descriptorpb.SourceCodeInfo) *locationIndex {
+	root := &locationIndex{}
+	for order, loc := range info.GetLocation() {
+		node := root
+		for _, part := range loc.Path {
+			child, ok := node.children[part]
+			if !ok {
+				if node.children == nil {
+					node.children = map[int32]*locationIndex{}
+				}
+				child = &locationIndex{}
+				node.children[part] = child
+			}
+			node = child
+		}
+		node.locs = append(node.locs, indexedLocation{order: order, loc: loc})
+	}
+	return root
+}
+
+// under returns the locations within the path, with paths relative to it, in
+// the order of the file's source info. It matches subLocations over all of
+// the file's locations.
+func (idx *locationIndex) under(path []int32) []*descriptorpb.SourceCodeInfo_Location {
+	node := idx
+	for _, part := range path {
+		node = node.children[part]
+		if node == nil {
+			return nil
+		}
+	}
+
+	var found []indexedLocation
+	var walk func(node *locationIndex)
+	walk = func(node *locationIndex) {
+		found = append(found, node.locs...)
+		for _, child := range node.children {
+			walk(child)
+		}
+	}
+	walk(node)
+	sort.Slice(found, func(i, j int) bool {
+		return found[i].order < found[j].order
+	})
+
+	filtered := make([]*descriptorpb.SourceCodeInfo_Location, 0, len(found))
+	for _, item := range found {
+		loc := item.loc
+		filtered = append(filtered, &descriptorpb.SourceCodeInfo_Location{
+			Path:                    loc.Path[len(path):],
+			Span:                    loc.Span,
+			LeadingComments:         loc.LeadingComments,
+			TrailingComments:        loc.TrailingComments,
+			LeadingDetachedComments: loc.LeadingDetachedComments,
+		})
+	}
+	return filtered
+}
+
+// fileLocations is the location index of one file, built once by whichever
+// element of the file asks first.
+type fileLocations struct {
+	once sync.Once
+	idx  *locationIndex
+}
+
+// fileLocations returns the location index of the file, built on first use and
+// kept for the other elements of the file. It is nil when the file has no
+// source info.
+func (fb *Builder) fileLocations(file protoreflect.FileDescriptor) *locationIndex {
+	if fb == nil {
+		return buildFileLocations(file)
+	}
+	fb.locationsMu.Lock()
+	entry, ok := fb.locations[file]
+	if !ok {
+		if fb.locations == nil {
+			fb.locations = map[protoreflect.FileDescriptor]*fileLocations{}
+		}
+		entry = &fileLocations{}
+		fb.locations[file] = entry
+	}
+	fb.locationsMu.Unlock()
+
+	// Other files are indexed at the same time, elements of this file wait
+	// for the one index.
+	entry.once.Do(func() {
+		entry.idx = buildFileLocations(file)
+	})
+	return entry.idx
+}
+
+func buildFileLocations(file protoreflect.FileDescriptor) *locationIndex {
+	info := protodesc.ToFileDescriptorProto(file).SourceCodeInfo
+	if info == nil {
+		return nil
+	}
+	return newLocationIndex(info)
+}
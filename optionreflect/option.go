@@ -2,6 +2,7 @@ package optionreflect
 
 import (
 	"fmt"
+	"slices"
 	"strings"
 
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -17,10 +18,107 @@ type OptionDefinition struct {
 	Desc  protoreflect.FieldDescriptor
 	Value protoreflect.Value
 
+	// ListItem is set when Value is a single item of a repeated option, which
+	// is specified by repeating the option for each item.
+	ListItem  bool
+	listIndex int
+
 	SourceLocation *OptionSourceLocation
+
+	// Unresolved is set, in place of the descriptors and value, for options
+	// whose extension is not known to a lenient Builder.
+	Unresolved *UnresolvedOption
+
+	// Statements are the statements, or entries in a field's option list,
+	// which set the option in the source, in source order.
+	Statements []*OptionStatement
+
+	// AsWritten is set on the definitions from SplitStatements, which are
+	// printed with the SubPath of the statement rather than simplified.
+	AsWritten bool
+}
+
+// UnresolvedOption is an extension option which could not be decoded, as the
+// extension is not known.
+type UnresolvedOption struct {
+	Number protoreflect.FieldNumber
+
+	// Raw is the wire encoding of each occurrence of the field, in order.
+	Raw []byte
+
+	// Locations are the source locations of each statement which set the
+	// option. Empty without source info.
+	Locations []*descriptorpb.SourceCodeInfo_Location
+}
+
+// ListItems splits a repeated option into one definition per item. Each item
+// is located at the statement which set it, when known.
+func (opt *OptionDefinition) ListItems() []*OptionDefinition {
+	list := opt.Value.List()
+	items := make([]*OptionDefinition, 0, list.Len())
+	for idx := 0; idx < list.Len(); idx++ {
+		item := *opt
+		item.SubPath = append([]string{}, opt.SubPath...)
+		item.Value = list.Get(idx)
+		item.ListItem = true
+		item.listIndex = idx
+		for _, statement := range opt.Statements {
+			if len(statement.Path) == 1 && int(statement.Path[0]) == idx {
+				item.SourceLocation = statement.SourceLocation
+			}
+		}
+		items = append(items, &item)
+	}
+	return items
+}
+
+// Walk walks the value of the option, with the comments written inside the
+// value when the source locations include them.
+func (opt *OptionDefinition) Walk() (OptionField, error) {
+	walker := optionWalker{}
+	path, ok := opt.valuePath()
+	if ok {
+		walker.loc = opt.SourceLocation
+	}
+	if opt.ListItem {
+		return walker.item(opt.Desc, opt.Value, path)
+	}
+	return walker.field(opt.Desc, opt.Value, path)
+}
+
+// valuePath is the path of the value from the root option field, following
+// the SubPath, then the index of a list item. Names which are not plain
+// fields, like extensions of features, can't be followed.
+func (opt *OptionDefinition) valuePath() ([]int32, bool) {
+	path := make([]int32, 0, len(opt.SubPath)+1)
+	desc := opt.RootType
+	for _, name := range opt.SubPath {
+		if desc.Message() == nil {
+			return nil, false
+		}
+		field := desc.Message().Fields().ByName(protoreflect.Name(name))
+		if field == nil {
+			return nil, false
+		}
+		path = append(path, int32(field.Number()))
+		desc = field
+	}
+	if opt.ListItem {
+		path = append(path, int32(opt.listIndex))
+	}
+	return path, true
 }
 
 func (opt *OptionDefinition) FullType() string {
+	if opt.Unresolved != nil {
+		return fmt.Sprintf("(%d)", opt.Unresolved.Number)
+	}
+
+	if !opt.RootType.IsExtension() {
+		// Built in options are not wrapped in brackets
+		return strings.Join(append([]string{string(opt.RootType.Name())}, opt.SubPath...), ".")
+	}
+
 	if len(opt.SubPath) == 0 {
 		return fmt.Sprintf("(%s)", opt.RootType.FullName())
 	}
@@ -37,7 +135,12 @@ func (opt *OptionDefinition) Simplify(maxDepth int) {
 		return
 	}
 
-	if encoderDesc.Kind() != protoreflect.MessageKind {
+	if opt.ListItem {
+		// The item is the value of the repeated field, it isn't walkable
+		return
+	}
+
+	if !isMessage(encoderDesc) {
 		// Can't walk scalars.
 		return
 
@@ -75,6 +178,12 @@ func (opt *OptionDefinition) Simplify(maxDepth int) {
 		return
 	}
 
+	// The comments of a field are written inside the message, moving it to
+	// the path would drop them.
+	if path, ok := opt.valuePath(); ok && opt.SourceLocation.commentsAt(append(path, int32(field.Number()))) != nil {
+		return
+	}
+
 	opt.SubPath = append(opt.SubPath, string(field.Name()))
 	opt.Desc = field
 	opt.Value = encoderMessageVal.Get(field)
@@ -93,24 +202,57 @@ type OptionSourceLocation struct {
 
 	Src    *descriptorpb.SourceCodeInfo_Location
 	Parent protoreflect.SourceLocation
+
+	// Values are the locations of the fields and items within the option
+	// value, with paths relative to the option field. They are only recorded
+	// by compilers when asked for, e.g. protocompile's
+	// SourceInfoExtraOptionLocations.
+	Values []*descriptorpb.SourceCodeInfo_Location
+}
+
+// commentsAt returns the location for the path within the option value, when
+// it has comments of its own.
+func (loc *OptionSourceLocation) commentsAt(path []int32) *descriptorpb.SourceCodeInfo_Location {
+	if loc == nil {
+		return nil
+	}
+	for _, value := range loc.Values {
+		if !slices.Equal(value.Path, path) {
+			continue
+		}
+		if loc.Src != nil && slices.Equal(value.Span, loc.Src.Span) {
+			// The statement itself, e.g. `option (foo).bar = 1;`, has the
+			// comments of the option.
+			continue
+		}
+		if value.LeadingComments != nil || value.TrailingComments != nil || len(value.LeadingDetachedComments) > 0 {
+			return value
+		}
+	}
+	return nil
 }
 
-func buildSourceLocation(optionsLocs []*descriptorpb.SourceCodeInfo_Location, parentLocation protoreflect.SourceLocation, field protoreflect.FieldDescriptor) *OptionSourceLocation {
+func buildSourceLocation(optionsLocs []*descriptorpb.SourceCodeInfo_Location, parentLocation protoreflect.SourceLocation, num protoreflect.FieldNumber) *OptionSourceLocation {
 
-	num := field.Number()
-	srcLoc := subLocations(optionsLocs, []int32{int32(num)})
+	// With locations for option values there are also locations within the
+	// statement, the statement is the outermost.
+	srcLoc := statementLocations(optionsLocs, num)
 
 	if len(srcLoc) != 1 {
 		return nil
 	}
 
+	return newSourceLocation(srcLoc[0], parentLocation, subLocations(optionsLocs, []int32{int32(num)}))
+}
+
+func newSourceLocation(src *descriptorpb.SourceCodeInfo_Location, parentLocation protoreflect.SourceLocation, values []*descriptorpb.SourceCodeInfo_Location) *OptionSourceLocation {
 	singleLine := false
-	startLine := srcLoc[0].Span[0]
+	startLine := src.Span[0]
 	var endLine int32
-	if len(srcLoc[0].Span) == 3 {
+	if len(src.Span) == 3 {
 		endLine = startLine
 	} else {
-		endLine = srcLoc[0].Span[2]
+		endLine = src.Span[2]
 	}
 	if startLine == endLine {
 		singleLine = true
@@ -121,8 +263,58 @@ func buildSourceLocation(optionsLocs []*descriptorpb.SourceCodeInfo_Location, pa
 		SingleLine:       singleLine,
 		StartLine:        startLine,
 
-		Src:    srcLoc[0],
+		Src:    src,
 		Parent: parentLocation,
+		Values: values,
 	}
 
 }
+
+// statementLocations returns the outermost locations for the option number,
+// one for each statement which sets part of the option.
+func statementLocations(optionsLocs []*descriptorpb.SourceCodeInfo_Location, num protoreflect.FieldNumber) []*descriptorpb.SourceCodeInfo_Location {
+	candidates := subLocations(optionsLocs, []int32{int32(num)})
+	out := make([]*descriptorpb.SourceCodeInfo_Location, 0, len(candidates))
+	for _, loc := range candidates {
+		contained := false
+		for _, other := range candidates {
+			if other != loc && spanContains(other.Span, loc.Span) && !slices.Equal(other.Span, loc.Span) {
+				contained = true
+				break
+			}
+		}
+		if contained {
+			continue
+		}
+		duplicate := false
+		for _, existing := range out {
+			if slices.Equal(existing.Span, loc.Span) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			out = append(out, loc)
+		}
+	}
+	return out
+}
+
+// spanContains compares source spans, which are [startLine, startCol, endCol]
+// or [startLine, startCol, endLine, endCol]
+func spanContains(outer, inner []int32) bool {
+	outerStart, outerEnd := spanBounds(outer)
+	innerStart, innerEnd := spanBounds(inner)
+	return !lessPos(innerStart, outerStart) && !lessPos(outerEnd, innerEnd)
+}
+
+func spanBounds(span []int32) ([2]int32, [2]int32) {
+	if len(span) == 3 {
+		return [2]int32{span[0], span[1]}, [2]int32{span[0], span[2]}
+	}
+	return [2]int32{span[0], span[1]}, [2]int32{span[2], span[3]}
+}
+
+func lessPos(a, b [2]int32) bool {
+	return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+}
@@ -0,0 +1,305 @@
+package optionreflect
+
+import (
+	"slices"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// OptionStatement is one statement, or entry in a field's option list, which
+// set part of an option. The path records how the option was spelled:
+// `option (a).b = 1;` has the path [b], `option (a) = {b: 1};` an empty path.
+type OptionStatement struct {
+	// Path is the path of the value set by the statement, from the option
+	// field. It holds field numbers, and the index of items of repeated
+	// fields.
+	Path []int32
+
+	SourceLocation *OptionSourceLocation
+}
+
+func buildStatements(optionsLocs []*descriptorpb.SourceCodeInfo_Location, parentLocation protoreflect.SourceLocation, num protoreflect.FieldNumber) []*OptionStatement {
+	values := subLocations(optionsLocs, []int32{int32(num)})
+	locs := statementLocations(optionsLocs, num)
+	statements := make([]*OptionStatement, 0, len(locs))
+	for _, loc := range locs {
+		statements = append(statements, &OptionStatement{
+			Path:           loc.Path,
+			SourceLocation: newSourceLocation(loc, parentLocation, values),
+		})
+	}
+	slices.SortStableFunc(statements, func(a, b *OptionStatement) int {
+		aStart, _ := spanBounds(a.SourceLocation.Src.Span)
+		bStart, _ := spanBounds(b.SourceLocation.Src.Span)
+		if lessPos(aStart, bStart) {
+			return -1
+		}
+		if lessPos(bStart, aStart) {
+			return 1
+		}
+		return 0
+	})
+	return statements
+}
+
+// SplitStatements returns one definition for each statement which set a
+// message option, with the value that statement set, so that the option can
+// be printed the way it was written. It returns false when the statements
+// are not known, or don't account for the whole value, e.g. when the source
+// info doesn't match the descriptor.
+func (opt *OptionDefinition) SplitStatements() ([]*OptionDefinition, bool) {
+	if len(opt.Statements) == 0 || opt.ListItem || len(opt.SubPath) > 0 {
+		return nil, false
+	}
+	if opt.Desc.IsList() || opt.Desc.IsMap() || !isMessage(opt.Desc) {
+		return nil, false
+	}
+
+	root := opt.Value.Message()
+	rebuilt := root.New()
+	out := make([]*OptionDefinition, 0, len(opt.Statements))
+	for _, statement := range opt.Statements {
+		def, ok := opt.statementDefinition(root, statement)
+		if !ok {
+			return nil, false
+		}
+		if !mergeAtPath(rebuilt, statement.Path, def.Value) {
+			return nil, false
+		}
+		out = append(out, def)
+	}
+
+	if !proto.Equal(rebuilt.Interface(), root.Interface()) {
+		return nil, false
+	}
+	return out, true
+}
+
+// statementDefinition builds the definition for the value set by the
+// statement, which is the value at its path less the parts set by other
+// statements within it.
+func (opt *OptionDefinition) statementDefinition(root protoreflect.Message, statement *OptionStatement) (*OptionDefinition, bool) {
+	def := &OptionDefinition{
+		Context:        opt.Context,
+		RootType:       opt.RootType,
+		Desc:           opt.Desc,
+		Value:          opt.Value,
+		SourceLocation: statement.SourceLocation,
+		AsWritten:      true,
+	}
+
+	msg := root
+	path := statement.Path
+	for idx := 0; idx < len(path); idx++ {
+		if msg == nil {
+			return nil, false
+		}
+		field := msg.Descriptor().Fields().ByNumber(protoreflect.FieldNumber(path[idx]))
+		if field == nil || field.IsMap() || !msg.Has(field) {
+			return nil, false
+		}
+		def.SubPath = append(def.SubPath, string(field.Name()))
+		def.Desc = field
+		def.Value = msg.Get(field)
+
+		if field.IsList() {
+			if idx+1 >= len(path) {
+				// The list was set as a whole.
+				msg = nil
+				break
+			}
+			idx++
+			list := def.Value.List()
+			if int(path[idx]) >= list.Len() {
+				return nil, false
+			}
+			def.ListItem = true
+			def.listIndex = int(path[idx])
+			def.Value = list.Get(def.listIndex)
+		}
+
+		msg = nil
+		if isMessage(field) && (!field.IsList() || def.ListItem) {
+			msg = def.Value.Message()
+		}
+	}
+
+	if msg == nil {
+		return def, true
+	}
+
+	// Remove what deeper statements set, the deepest list items first so that
+	// the indexes of the others hold.
+	within := make([][]int32, 0)
+	for _, other := range opt.Statements {
+		if len(other.Path) > len(path) && slices.Equal(other.Path[:len(path)], path) {
+			within = append(within, other.Path[len(path):])
+		}
+	}
+	if len(within) == 0 {
+		return def, true
+	}
+	slices.SortFunc(within, func(a, b []int32) int {
+		return -slices.Compare(a, b)
+	})
+
+	clone := proto.Clone(msg.Interface()).ProtoReflect()
+	for _, rel := range within {
+		if !clearAtPath(clone, rel) {
+			return nil, false
+		}
+	}
+	def.Value = protoreflect.ValueOfMessage(clone)
+	return def, true
+}
+
+// clearAtPath clears the field or list item at the path. Messages left empty
+// are cleared too, they were only there to hold what the path set.
+func clearAtPath(msg protoreflect.Message, path []int32) bool {
+	type parent struct {
+		msg   protoreflect.Message
+		field protoreflect.FieldDescriptor
+	}
+	parents := make([]parent, 0, len(path))
+	prune := func() {
+		for idx := len(parents) - 1; idx >= 0; idx-- {
+			p := parents[idx]
+			if isEmpty(p.msg.Get(p.field).Message()) {
+				p.msg.Clear(p.field)
+			}
+		}
+	}
+
+	for idx := 0; idx < len(path); idx++ {
+		field := msg.Descriptor().Fields().ByNumber(protoreflect.FieldNumber(path[idx]))
+		if field == nil || field.IsMap() || !msg.Has(field) {
+			return false
+		}
+		last := idx == len(path)-1
+		if !field.IsList() {
+			if last {
+				msg.Clear(field)
+				prune()
+				return true
+			}
+			if !isMessage(field) {
+				return false
+			}
+			parents = append(parents, parent{msg: msg, field: field})
+			msg = msg.Mutable(field).Message()
+			continue
+		}
+
+		if last {
+			msg.Clear(field)
+			prune()
+			return true
+		}
+		idx++
+		list := msg.Mutable(field).List()
+		item := int(path[idx])
+		if item >= list.Len() {
+			return false
+		}
+		if idx == len(path)-1 {
+			removeListItem(list, item)
+			if list.Len() == 0 {
+				msg.Clear(field)
+			}
+			prune()
+			return true
+		}
+		if !isMessage(field) {
+			return false
+		}
+		// Items are not pruned, an empty item is still an item.
+		parents = parents[:0]
+		msg = list.Get(item).Message()
+	}
+	return false
+}
+
+func isEmpty(msg protoreflect.Message) bool {
+	empty := true
+	msg.Range(func(protoreflect.FieldDescriptor, protoreflect.Value) bool {
+		empty = false
+		return false
+	})
+	return empty && len(msg.GetUnknown()) == 0
+}
+
+func removeListItem(list protoreflect.List, item int) {
+	kept := make([]protoreflect.Value, 0, list.Len()-1)
+	for idx := 0; idx < list.Len(); idx++ {
+		if idx != item {
+			kept = append(kept, list.Get(idx))
+		}
+	}
+	list.Truncate(0)
+	for _, val := range kept {
+		list.Append(val)
+	}
+}
+
+// mergeAtPath merges the value into the message at the path, as a compiler
+// does for each option statement: messages are merged, list items appended
+// and scalars set.
+func mergeAtPath(msg protoreflect.Message, path []int32, val protoreflect.Value) bool {
+	if len(path) == 0 {
+		proto.Merge(msg.Interface(), val.Message().Interface())
+		return true
+	}
+
+	for idx := 0; idx < len(path); idx++ {
+		field := msg.Descriptor().Fields().ByNumber(protoreflect.FieldNumber(path[idx]))
+		if field == nil || field.IsMap() {
+			return false
+		}
+		last := idx == len(path)-1
+
+		if !field.IsList() {
+			switch {
+			case last && isMessage(field):
+				proto.Merge(msg.Mutable(field).Message().Interface(), val.Message().Interface())
+				return true
+			case last:
+				msg.Set(field, val)
+				return true
+			case !isMessage(field):
+				return false
+			}
+			msg = msg.Mutable(field).Message()
+			continue
+		}
+
+		list := msg.Mutable(field).List()
+		if last {
+			// The list as a whole
+			src := val.List()
+			for item := 0; item < src.Len(); item++ {
+				list.Append(src.Get(item))
+			}
+			return true
+		}
+		idx++
+		item := int(path[idx])
+		switch {
+		case item == list.Len() && idx == len(path)-1:
+			list.Append(val)
+			return true
+		case item == list.Len() && isMessage(field):
+			list.Append(list.NewElement())
+		case item >= list.Len():
+			return false
+		case idx == len(path)-1 && isMessage(field):
+			proto.Merge(list.Get(item).Message().Interface(), val.Message().Interface())
+			return true
+		case idx == len(path)-1 || !isMessage(field):
+			return false
+		}
+		msg = list.Get(item).Message()
+	}
+	return false
+}
@@ -1,8 +1,11 @@
 package optionreflect
 
 import (
+	"fmt"
 	"math"
 	"math/bits"
+	"slices"
+	"sort"
 	"strconv"
 	"unicode/utf8"
 
@@ -22,64 +25,155 @@ type OptionField struct {
 	Key         string
 	ScalarValue string
 	Children    []OptionField
+
+	// FieldNumber is the number of the field, or of the list the item is in.
+	// Zero for map entries.
+	FieldNumber protoreflect.FieldNumber
+
+	// The comments written around the field or list item inside the option
+	// value, when the file was compiled with source info for option values.
+	LeadingDetachedComments []string
+	LeadingComments         string
+	TrailingComments        string
 }
 
-func WalkOptionField(fieldDesc protoreflect.FieldDescriptor, val protoreflect.Value) OptionField {
+// HasComments is true when the field, or anything within it, has comments.
+func (of OptionField) HasComments() bool {
+	if of.LeadingComments != "" || of.TrailingComments != "" || len(of.LeadingDetachedComments) > 0 {
+		return true
+	}
+	for _, child := range of.Children {
+		if child.HasComments() {
+			return true
+		}
+	}
+	return false
+}
+
+// WalkOptionField walks the value of a field. It fails for values which have
+// no text form in an option, like groups.
+func WalkOptionField(fieldDesc protoreflect.FieldDescriptor, val protoreflect.Value) (OptionField, error) {
+	return optionWalker{}.field(fieldDesc, val, nil)
+}
+
+// WalkOptionItem walks a single item of a repeated field.
+func WalkOptionItem(fieldDesc protoreflect.FieldDescriptor, val protoreflect.Value) (OptionField, error) {
+	return optionWalker{}.item(fieldDesc, val, nil)
+}
+
+// optionWalker copies the comments from the source locations of the option
+// value onto the fields and items as they are walked. Paths are relative to
+// the option field, as in OptionSourceLocation.Values.
+type optionWalker struct {
+	loc *OptionSourceLocation
+}
+
+func (w optionWalker) field(fieldDesc protoreflect.FieldDescriptor, val protoreflect.Value, path []int32) (OptionField, error) {
 	if fieldDesc.IsList() {
-		return walkOptionList(fieldDesc, val.List())
+		return w.list(fieldDesc, val.List(), path)
 	}
 
 	if fieldDesc.IsMap() {
 		return walkOptionMap(fieldDesc, val.Map())
 	}
 
-	if fieldDesc.Kind() == protoreflect.MessageKind {
-		return walkOptionMessage(fieldDesc, val.Message())
+	if isMessage(fieldDesc) {
+		return w.message(fieldDesc, val.Message(), path)
 	}
 
 	return walkOptionScalar(fieldDesc, val)
 }
 
-func walkOptionList(fieldDesc protoreflect.FieldDescriptor, list protoreflect.List) OptionField {
-	out := OptionField{
-		FieldType: FieldTypeArray,
-		Key:       string(fieldDesc.Name()),
-		Children:  make([]OptionField, 0, list.Len()),
+func (w optionWalker) item(fieldDesc protoreflect.FieldDescriptor, val protoreflect.Value, path []int32) (OptionField, error) {
+	if isMessage(fieldDesc) {
+		return w.message(fieldDesc, val.Message(), path)
 	}
+	return walkOptionScalar(fieldDesc, val)
+}
 
-	if fieldDesc.Kind() == protoreflect.MessageKind {
-		for i := 0; i < list.Len(); i++ {
-			item := list.Get(i)
-			msgChild := walkOptionMessage(fieldDesc, item.Message())
-			out.Children = append(out.Children, msgChild)
-		}
-		return out
+// comments sets the comments of the location at path on the field.
+func (w optionWalker) comments(field *OptionField, path []int32) {
+	src := w.loc.commentsAt(path)
+	if src == nil {
+		return
+	}
+	field.LeadingDetachedComments = src.LeadingDetachedComments
+	field.LeadingComments = src.GetLeadingComments()
+	field.TrailingComments = src.GetTrailingComments()
+}
+
+func (w optionWalker) list(fieldDesc protoreflect.FieldDescriptor, list protoreflect.List, path []int32) (OptionField, error) {
+	out := OptionField{
+		FieldType:   FieldTypeArray,
+		Key:         fieldKey(fieldDesc),
+		Children:    make([]OptionField, 0, list.Len()),
+		FieldNumber: fieldDesc.Number(),
 	}
 
 	for i := 0; i < list.Len(); i++ {
-		item := list.Get(i)
-		scalarChild := walkOptionScalar(fieldDesc, item)
-		out.Children = append(out.Children, scalarChild)
+		itemPath := append(slices.Clip(path), int32(i))
+		child, err := w.item(fieldDesc, list.Get(i), itemPath)
+		if err != nil {
+			return OptionField{}, err
+		}
+		w.comments(&child, itemPath)
+		out.Children = append(out.Children, child)
 	}
 
-	return out
+	return out, nil
 
 }
 
-func walkOptionMap(fieldDesc protoreflect.FieldDescriptor, mp protoreflect.Map) OptionField {
-	out := OptionField{
-		FieldType: FieldTypeArray,
-		Key:       string(fieldDesc.Name()),
-		Children:  make([]OptionField, 0, mp.Len()),
+// isMessage is true for fields whose values are messages, which includes
+// proto2 groups and fields with delimited encoding.
+func isMessage(field protoreflect.FieldDescriptor) bool {
+	return field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind
+}
+
+// fieldKey is the name of the field in a message literal, which for proto2
+// groups is the name of the group's message type. Fields with delimited
+// encoding in editions keep their own name, either is accepted.
+func fieldKey(field protoreflect.FieldDescriptor) string {
+	if !field.IsExtension() && field.Kind() == protoreflect.GroupKind && field.Syntax() == protoreflect.Proto2 {
+		return string(field.Message().Name())
 	}
+	return string(field.Name())
+}
 
-	if fieldDesc.MapValue().Kind() == protoreflect.MessageKind {
-		panic("map value is message, not supported")
+// walkOptionMap walks the entries of a map sorted by key. The order need not
+// match the source, so comments in map values are not kept.
+func walkOptionMap(fieldDesc protoreflect.FieldDescriptor, mp protoreflect.Map) (OptionField, error) {
+	out := OptionField{
+		FieldType:   FieldTypeArray,
+		Key:         fieldKey(fieldDesc),
+		Children:    make([]OptionField, 0, mp.Len()),
+		FieldNumber: fieldDesc.Number(),
 	}
 
-	mp.Range(func(key protoreflect.MapKey, val protoreflect.Value) bool {
-		mapVal := walkOptionScalar(fieldDesc.MapValue(), val)
-		keyVal := walkOptionScalar(fieldDesc.MapKey(), key.Value())
+	keys := make([]protoreflect.MapKey, 0, mp.Len())
+	mp.Range(func(key protoreflect.MapKey, _ protoreflect.Value) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sortMapKeys(fieldDesc.MapKey().Kind(), keys)
+
+	for _, key := range keys {
+		val := mp.Get(key)
+
+		var mapVal OptionField
+		var err error
+		if isMessage(fieldDesc.MapValue()) {
+			mapVal, err = optionWalker{}.message(fieldDesc.MapValue(), val.Message(), nil)
+		} else {
+			mapVal, err = walkOptionScalar(fieldDesc.MapValue(), val)
+		}
+		if err != nil {
+			return OptionField{}, err
+		}
+		keyVal, err := walkOptionScalar(fieldDesc.MapKey(), key.Value())
+		if err != nil {
+			return OptionField{}, err
+		}
 		mapVal.Key = "value"
 		keyVal.Key = "key"
 
@@ -91,17 +185,36 @@ func walkOptionMap(fieldDesc protoreflect.FieldDescriptor, mp protoreflect.Map)
 			},
 		}
 		out.Children = append(out.Children, kvChild)
-		return true
-	})
+	}
 
-	return out
+	return out, nil
+}
+
+// sortMapKeys sorts keys by their natural order for the key type, which
+// matches the order prototext uses.
+func sortMapKeys(kind protoreflect.Kind, keys []protoreflect.MapKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		switch kind {
+		case protoreflect.BoolKind:
+			return !keys[i].Bool() && keys[j].Bool()
+		case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+			protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+			return keys[i].Int() < keys[j].Int()
+		case protoreflect.Uint32Kind, protoreflect.Fixed32Kind,
+			protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+			return keys[i].Uint() < keys[j].Uint()
+		default:
+			return keys[i].String() < keys[j].String()
+		}
+	})
 }
 
-func walkOptionMessage(fieldDesc protoreflect.FieldDescriptor, msgVal protoreflect.Message) OptionField {
+func (w optionWalker) message(fieldDesc protoreflect.FieldDescriptor, msgVal protoreflect.Message, path []int32) (OptionField, error) {
 	out := OptionField{
-		FieldType: FieldTypeMessage,
-		Key:       string(fieldDesc.Name()),
-		Children:  make([]OptionField, 0),
+		FieldType:   FieldTypeMessage,
+		Key:         fieldKey(fieldDesc),
+		Children:    make([]OptionField, 0),
+		FieldNumber: fieldDesc.Number(),
 	}
 
 	fields := msgVal.Descriptor().Fields()
@@ -112,23 +225,29 @@ func walkOptionMessage(fieldDesc protoreflect.FieldDescriptor, msgVal protorefle
 		}
 		val := msgVal.Get(fieldRefl)
 
-		child := WalkOptionField(fieldRefl, val)
+		childPath := append(slices.Clip(path), int32(fieldRefl.Number()))
+		child, err := w.field(fieldRefl, val, childPath)
+		if err != nil {
+			return OptionField{}, err
+		}
+		w.comments(&child, childPath)
 		out.Children = append(out.Children, child)
 	}
-	return out
+	return out, nil
 }
 
-func walkOptionScalar(fieldDesc protoreflect.FieldDescriptor, val protoreflect.Value) OptionField {
+func walkOptionScalar(fieldDesc protoreflect.FieldDescriptor, val protoreflect.Value) (OptionField, error) {
 	scalar, ok := marshalSingular(fieldDesc, val)
 	if !ok {
-		panic("unexpected scalar")
+		return OptionField{}, fmt.Errorf("field %s: %s values are not supported in options", fieldDesc.FullName(), fieldDesc.Kind())
 	}
 
 	return OptionField{
 		FieldType:   FieldTypeScalar,
-		Key:         string(fieldDesc.Name()),
+		Key:         fieldKey(fieldDesc),
 		ScalarValue: scalar,
-	}
+		FieldNumber: fieldDesc.Number(),
+	}, nil
 }
 
 // adapted from prototext
@@ -190,6 +309,12 @@ func fFloat(n float64, bitSize int) string {
 	}
 }
 
+// QuoteString returns the string as a quoted and escaped literal, as it would
+// appear in a proto file.
+func QuoteString(in string) string {
+	return prototextString(in)
+}
+
 func prototextString(in string) string {
 	outputASCII := true
 	out := make([]byte, 0, len(in)+2)
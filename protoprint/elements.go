@@ -7,6 +7,9 @@ import (
 type sourceElement struct {
 	typeOrder      int
 	descriptor     protoreflect.Descriptor
+	statement      *rangeStatement
+	extension      *extBlock
+	order          int // for elements which are not descriptors
 	sourceLocation protoreflect.SourceLocation
 }
 
@@ -35,6 +38,24 @@ func (se *sourceElements) add(d protoreflect.Descriptor) {
 	})
 }
 
+func (se *sourceElements) addStatement(stmt *rangeStatement) {
+	*se = append(*se, sourceElement{
+		statement:      stmt,
+		order:          len(*se),
+		sourceLocation: stmt.location,
+	})
+}
+
+func (se *sourceElements) addExtension(block *extBlock) {
+	*se = append(*se, sourceElement{
+		// without source info, extend blocks go first
+		typeOrder:      -1,
+		extension:      block,
+		order:          len(*se),
+		sourceLocation: block.location,
+	})
+}
+
 func (se sourceElements) Len() int {
 	return len(se)
 }
@@ -44,7 +65,15 @@ func (se sourceElements) Less(i, j int) bool {
 		if se[i].typeOrder != se[j].typeOrder {
 			return se[i].typeOrder < se[j].typeOrder
 		}
-		return se[i].descriptor.Index() < se[j].descriptor.Index()
+		if (se[i].descriptor == nil) != (se[j].descriptor == nil) {
+			// statements and blocks have no index, they go after the
+			// descriptors
+			return se[j].descriptor == nil
+		}
+		if se[i].descriptor == nil {
+			return se[i].order < se[j].order
+		}
+		return declarationIndex(se[i].descriptor) < declarationIndex(se[j].descriptor)
 	}
 	return se[i].sourceLocation.StartLine < se[j].sourceLocation.StartLine
 }
@@ -52,3 +81,12 @@ func (se sourceElements) Less(i, j int) bool {
 func (se sourceElements) Swap(i, j int) {
 	se[i], se[j] = se[j], se[i]
 }
+
+// declarationIndex orders descriptors of the same type without source info. A
+// oneof is placed with its first field, as fields and oneofs share an order.
+func declarationIndex(desc protoreflect.Descriptor) int {
+	if oneof, ok := desc.(protoreflect.OneofDescriptor); ok && oneof.Fields().Len() > 0 {
+		return oneof.Fields().Get(0).Index()
+	}
+	return desc.Index()
+}
@@ -0,0 +1,87 @@
+package protoprint
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/pentops/prototools/optionreflect"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Error is a file which could not be printed, with the element which failed
+// and its position in the source when known.
+type Error struct {
+	Filename string
+
+	// Element is the full name of the descriptor being printed, empty when
+	// the error is not for one element.
+	Element protoreflect.FullName
+
+	// Line and Column are 1-based, zero when the source info doesn't locate
+	// the element.
+	Line   int
+	Column int
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	pos := e.Filename
+	if e.Line > 0 {
+		pos = fmt.Sprintf("%s:%d:%d", pos, e.Line, e.Column)
+	}
+	if e.Element == "" {
+		return fmt.Sprintf("%s: %s", pos, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %s", pos, e.Element, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// fileError attaches the file to the error, unless it already is an Error.
+func fileError(file protoreflect.FileDescriptor, err error) error {
+	if errors.As(err, new(*Error)) {
+		return err
+	}
+	return &Error{
+		Filename: file.Path(),
+		Err:      err,
+	}
+}
+
+// elementError attaches the element and its position to the error, unless it
+// is already an Error for an element within it.
+func elementError(desc protoreflect.Descriptor, err error) error {
+	if errors.As(err, new(*Error)) {
+		return err
+	}
+	out := &Error{
+		Filename: desc.ParentFile().Path(),
+		Element:  desc.FullName(),
+		Err:      err,
+	}
+	if _, ok := desc.(protoreflect.FileDescriptor); !ok {
+		if loc := desc.ParentFile().SourceLocations().ByDescriptor(desc); loc.Path != nil {
+			out.Line = loc.StartLine + 1
+			out.Column = loc.StartColumn + 1
+		}
+	}
+	return out
+}
+
+// optionError attaches the element the option is set on, and the position of
+// the option statement when known.
+func optionError(opt *optionreflect.OptionDefinition, err error) error {
+	out := elementError(opt.Context, err)
+	var printErr *Error
+	if !errors.As(out, &printErr) || printErr.Err != err {
+		return out
+	}
+	if loc := opt.SourceLocation; loc != nil && loc.Src != nil && len(loc.Src.Span) >= 2 {
+		printErr.Line = int(loc.Src.Span[0]) + 1
+		printErr.Column = int(loc.Src.Span[1]) + 1
+	}
+	return printErr
+}
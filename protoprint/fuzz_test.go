@@ -0,0 +1,416 @@
+package protoprint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// FuzzRoundTrip generates a set of proto files from the input, then checks
+// that printing them is idempotent, and that each printed file describes the
+// same file.
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 3, 2, 1, 5, 7, 9, 1, 4, 2, 8})
+	f.Add([]byte("a fairly long seed to produce a file with a bit of everything in it"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		files := generateProtos(data)
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		logSource := func() {
+			for _, name := range names {
+				t.Logf("%s:\n%s", name, files[name])
+			}
+		}
+
+		input := compileFiles(t, files, names...)
+		printed := NewFileMap()
+		if err := PrintReflect(context.Background(), printed, input, Options{}); err != nil {
+			logSource()
+			t.Fatalf("printing generated source: %s", err)
+		}
+
+		for _, file := range input {
+			if err := Verify(context.Background(), file, printed[file.Path()]); err != nil {
+				logSource()
+				t.Fatalf("%s\nprinted:\n%s", err, printed[file.Path()])
+			}
+		}
+
+		printedFiles := map[string]string{}
+		for name, content := range printed {
+			printedFiles[name] = string(content)
+		}
+		reprinted := compileFiles(t, printedFiles, names...)
+		again := NewFileMap()
+		if err := PrintReflect(context.Background(), again, reprinted, Options{}); err != nil {
+			logSource()
+			t.Fatalf("printing printed source: %s", err)
+		}
+
+		for _, name := range names {
+			if !bytes.Equal(printed[name], again[name]) {
+				logSource()
+				assertEqualLines(t, strings.Split(string(printed[name]), "\n"), strings.Split(string(again[name]), "\n"))
+				t.FailNow()
+			}
+		}
+	})
+}
+
+// protoGenerator writes valid proto source, making each choice from the next
+// byte of the input. Once the input runs out every choice is 0, which always
+// ends the file.
+type protoGenerator struct {
+	data []byte
+	out  *strings.Builder
+
+	proto3   bool
+	names    int
+	messages []string
+	enums    []string
+
+	// depScope qualifies the names declared in the dependency, which is in
+	// another package or the same one.
+	depScope string
+}
+
+// generateProtos writes the files of a test package: a dependency which
+// declares the option extensions, optionally a file which publicly imports it,
+// and the main file which uses them.
+func generateProtos(data []byte) map[string]string {
+	gen := &protoGenerator{
+		data: data,
+	}
+	files := map[string]string{}
+	files["fuzz/v1/dep.proto"] = gen.generate(gen.dependency)
+
+	imported := "fuzz/v1/dep.proto"
+	if gen.choice(2) == 1 {
+		files["fuzz/v1/public.proto"] = gen.generate(gen.publicImport)
+		imported = "fuzz/v1/public.proto"
+	}
+
+	files["fuzz/v1/test.proto"] = gen.generate(func() {
+		gen.file(imported)
+	})
+	return files
+}
+
+func (gen *protoGenerator) generate(write func()) string {
+	gen.out = &strings.Builder{}
+	write()
+	return gen.out.String()
+}
+
+func (gen *protoGenerator) choice(n int) int {
+	if len(gen.data) == 0 {
+		return 0
+	}
+	b := gen.data[0]
+	gen.data = gen.data[1:]
+	return int(b) % n
+}
+
+func (gen *protoGenerator) name(prefix string) string {
+	gen.names++
+	return fmt.Sprintf("%s%d", prefix, gen.names)
+}
+
+func (gen *protoGenerator) line(indent int, parts ...string) {
+	gen.out.WriteString(strings.Repeat("  ", indent))
+	for _, part := range parts {
+		gen.out.WriteString(part)
+	}
+	gen.out.WriteString("\n")
+}
+
+func (gen *protoGenerator) comment(indent int) {
+	switch gen.choice(4) {
+	case 1:
+		gen.line(indent, "// ", gen.name("comment"))
+	case 2:
+		gen.line(indent, "// ", gen.name("comment"))
+		gen.line(indent, "// ", gen.name("more"))
+	}
+}
+
+func (gen *protoGenerator) trailing() string {
+	if gen.choice(4) == 1 {
+		return " // " + gen.name("trailing")
+	}
+	return ""
+}
+
+// dependency writes the file which declares the option extensions, and a
+// message which the main file's fields can use.
+func (gen *protoGenerator) dependency() {
+	pkg := "fuzz.v1"
+	if gen.choice(2) == 1 {
+		pkg = "fuzz.dep.v1"
+		gen.depScope = pkg + "."
+	}
+	gen.line(0, `syntax = "proto2";`)
+	gen.line(0, "package ", pkg, ";")
+	gen.line(0, `import "google/protobuf/descriptor.proto";`)
+	gen.line(0, "message Rule {")
+	gen.line(1, "optional string name = 1;")
+	gen.line(1, "repeated int32 codes = 2;")
+	gen.line(1, "optional Rule child = 3;")
+	gen.line(0, "}")
+	gen.line(0, "message Shared {")
+	gen.line(1, "optional string id = 1;")
+	gen.line(0, "}")
+	gen.line(0, "extend google.protobuf.FieldOptions {")
+	gen.line(1, "optional string label = 50000;")
+	gen.line(1, "optional Rule field_rule = 50001;")
+	gen.line(0, "}")
+	gen.line(0, "extend google.protobuf.MessageOptions {")
+	gen.line(1, "optional Rule rule = 50000;")
+	gen.line(0, "}")
+	gen.messages = append(gen.messages, gen.depScope+"Shared")
+}
+
+// publicImport writes a file which passes the dependency on to its importers.
+func (gen *protoGenerator) publicImport() {
+	gen.line(0, `syntax = "proto3";`)
+	gen.line(0, "package fuzz.v1;")
+	gen.comment(0)
+	gen.line(0, `import public "fuzz/v1/dep.proto";`, gen.trailing())
+	if gen.choice(2) == 1 {
+		gen.line(0, "message Public {")
+		gen.line(1, gen.depScope, "Shared shared = 1;")
+		gen.line(0, "}")
+		gen.messages = append(gen.messages, "Public")
+	}
+}
+
+// ext is the name of an extension declared in the dependency.
+func (gen *protoGenerator) ext(name string) string {
+	return "(" + gen.depScope + name + ")"
+}
+
+func (gen *protoGenerator) file(imported string) {
+	gen.proto3 = gen.choice(2) == 0
+	if gen.proto3 {
+		gen.line(0, `syntax = "proto3";`)
+	} else {
+		gen.line(0, `syntax = "proto2";`)
+	}
+	gen.line(0, "package fuzz.v1;")
+	if gen.choice(2) == 1 {
+		gen.line(0, `option go_package = "github.com/fuzz/v1";`)
+	}
+	gen.line(0, `import "`, imported, `";`)
+
+	for count := gen.choice(5); count >= 0; count-- {
+		switch gen.choice(4) {
+		case 0, 1:
+			gen.message(0, "")
+		case 2:
+			gen.enum(0, "")
+		case 3:
+			gen.service()
+		}
+	}
+}
+
+// message writes a message, types are recorded with their scope so that they
+// can be referenced from anywhere in the package.
+func (gen *protoGenerator) message(indent int, scope string) {
+	name := gen.name("Msg")
+	gen.messages = append(gen.messages, scope+name)
+
+	gen.comment(indent)
+	gen.line(indent, "message ", name, " {", gen.trailing())
+	gen.messageOptions(indent + 1)
+
+	number := 1
+	for count := gen.choice(6); count > 0; count-- {
+		switch gen.choice(6) {
+		case 0, 1, 2:
+			gen.field(indent+1, &number, true)
+		case 3:
+			gen.oneof(indent+1, &number)
+		case 4:
+			if indent < 2 {
+				gen.message(indent+1, scope+name+".")
+			}
+		case 5:
+			gen.enum(indent+1, scope+name+".")
+		}
+	}
+
+	if gen.choice(3) == 1 {
+		gen.line(indent+1, fmt.Sprintf("reserved %d, %d to %d;", number, number+2, number+4))
+	}
+	gen.line(indent, "}")
+}
+
+// messageOptions writes the options of a message. The rule extension is set
+// by at most one form, as setting a field of it twice doesn't compile.
+func (gen *protoGenerator) messageOptions(indent int) {
+	if gen.choice(4) == 1 {
+		gen.line(indent, "option deprecated = true;")
+	}
+	switch gen.choice(5) {
+	case 1:
+		gen.line(indent, "option ", gen.ext("rule"), " = ", gen.ruleLiteral(0), ";")
+	case 2:
+		gen.line(indent, "option ", gen.ext("rule"), " = {")
+		gen.ruleFields(indent+1, 0)
+		gen.line(indent, "};")
+	case 3:
+		gen.line(indent, fmt.Sprintf("option %s.name = %q;", gen.ext("rule"), gen.name("rule")))
+		if gen.choice(2) == 1 {
+			gen.line(indent, "option ", gen.ext("rule"), ".child.codes = ", fmt.Sprint(gen.choice(100)), ";")
+		}
+	case 4:
+		gen.line(indent, "option ", gen.ext("rule"), ".child = ", gen.ruleLiteral(1), ";")
+	}
+}
+
+// ruleLiteral returns a Rule message value on one line.
+func (gen *protoGenerator) ruleLiteral(depth int) string {
+	parts := make([]string, 0)
+	if gen.choice(2) == 1 {
+		parts = append(parts, fmt.Sprintf("name: %q", gen.name("rule")))
+	}
+	switch gen.choice(3) {
+	case 1:
+		parts = append(parts, fmt.Sprintf("codes: %d", gen.choice(100)))
+	case 2:
+		parts = append(parts, fmt.Sprintf("codes: [%d, %d]", gen.choice(100), gen.choice(100)))
+	}
+	if depth < 2 && gen.choice(3) == 1 {
+		parts = append(parts, "child: "+gen.ruleLiteral(depth+1))
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
+
+// ruleFields writes the fields of a Rule message value, one per line.
+func (gen *protoGenerator) ruleFields(indent int, depth int) {
+	gen.line(indent, fmt.Sprintf("name: %q", gen.name("rule")))
+	if gen.choice(2) == 1 {
+		gen.line(indent, "codes: [")
+		gen.line(indent+1, fmt.Sprint(gen.choice(100)), ",")
+		gen.line(indent+1, fmt.Sprint(gen.choice(100)))
+		gen.line(indent, "]")
+	}
+	if depth < 2 && gen.choice(3) == 1 {
+		gen.line(indent, "child: {")
+		gen.ruleFields(indent+1, depth+1)
+		gen.line(indent, "}")
+	}
+}
+
+var scalarTypes = []string{"string", "int32", "int64", "bool", "bytes", "double", "fixed32", "sint64"}
+
+func (gen *protoGenerator) fieldType() string {
+	switch gen.choice(3) {
+	case 1:
+		if len(gen.messages) > 0 {
+			return gen.messages[gen.choice(len(gen.messages))]
+		}
+	case 2:
+		if len(gen.enums) > 0 {
+			return gen.enums[gen.choice(len(gen.enums))]
+		}
+	}
+	return scalarTypes[gen.choice(len(scalarTypes))]
+}
+
+func (gen *protoGenerator) field(indent int, number *int, labelled bool) {
+	name := gen.name("field_")
+	fieldType := gen.fieldType()
+
+	label := ""
+	if labelled {
+		switch gen.choice(4) {
+		case 1:
+			label = "repeated "
+		case 2:
+			label = "optional "
+		case 3:
+			fieldType = fmt.Sprintf("map<string, %s>", scalarTypes[gen.choice(len(scalarTypes))])
+		}
+	}
+	if label == "" && !gen.proto3 && labelled && !strings.HasPrefix(fieldType, "map<") {
+		label = "optional "
+	}
+
+	options := ""
+	switch gen.choice(7) {
+	case 1:
+		options = " [deprecated = true]"
+	case 2:
+		options = fmt.Sprintf(" [%s = %q]", gen.ext("label"), gen.name("label"))
+	case 3:
+		options = fmt.Sprintf(" [json_name = %q]", gen.name("json"))
+	case 4:
+		options = fmt.Sprintf(" [%s = %s]", gen.ext("field_rule"), gen.ruleLiteral(0))
+	case 5:
+		options = fmt.Sprintf(" [deprecated = true, %s.child.name = %q]", gen.ext("field_rule"), gen.name("rule"))
+	}
+
+	gen.comment(indent)
+	gen.line(indent, fmt.Sprintf("%s%s %s = %d%s;", label, fieldType, name, *number, options), gen.trailing())
+	*number++
+}
+
+func (gen *protoGenerator) oneof(indent int, number *int) {
+	gen.comment(indent)
+	gen.line(indent, "oneof ", gen.name("choice_"), " {", gen.trailing())
+	for count := gen.choice(3); count >= 0; count-- {
+		gen.field(indent+1, number, false)
+	}
+	gen.line(indent, "}")
+}
+
+func (gen *protoGenerator) enum(indent int, scope string) {
+	name := gen.name("Enum")
+	gen.enums = append(gen.enums, scope+name)
+
+	gen.comment(indent)
+	gen.line(indent, "enum ", name, " {", gen.trailing())
+	prefix := strings.ToUpper(name)
+	gen.line(indent+1, prefix, "_UNSPECIFIED = 0;", gen.trailing())
+	for idx := 1; idx <= gen.choice(4); idx++ {
+		options := ""
+		if gen.choice(4) == 1 {
+			options = " [deprecated = true]"
+		}
+		gen.comment(indent + 1)
+		gen.line(indent+1, fmt.Sprintf("%s_%s = %d%s;", prefix, gen.name("V"), idx, options))
+	}
+	gen.line(indent, "}")
+}
+
+func (gen *protoGenerator) service() {
+	if len(gen.messages) == 0 {
+		gen.message(0, "")
+	}
+
+	gen.comment(0)
+	gen.line(0, "service ", gen.name("Service"), " {", gen.trailing())
+	for count := gen.choice(4); count >= 0; count-- {
+		input := gen.messages[gen.choice(len(gen.messages))]
+		output := gen.messages[gen.choice(len(gen.messages))]
+		if gen.choice(3) == 1 {
+			input = "stream " + input
+		}
+		if gen.choice(3) == 1 {
+			output = "stream " + output
+		}
+		gen.comment(1)
+		gen.line(1, "rpc ", gen.name("Method"), "(", input, ") returns (", output, ");", gen.trailing())
+	}
+	gen.line(0, "}")
+}
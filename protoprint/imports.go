@@ -0,0 +1,82 @@
+package protoprint
+
+import (
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type importGroup int
+
+const (
+	importGroupWellKnown importGroup = iota
+	importGroupExternal
+	importGroupLocal
+)
+
+type importLine struct {
+	path     string
+	modifier string
+	group    importGroup
+	location protoreflect.SourceLocation
+}
+
+func (fb *fileBuilder) printImports(ff protoreflect.FileDescriptor) {
+	imports := ff.Imports()
+	if imports.Len() == 0 {
+		return
+	}
+
+	var options Options
+	var localFiles map[string]struct{}
+	if fb.out.printer != nil {
+		options = fb.out.printer.options
+		localFiles = fb.out.printer.localFiles
+	}
+
+	lines := make([]importLine, 0, imports.Len())
+	for idx := 0; idx < imports.Len(); idx++ {
+		dep := imports.Get(idx)
+		line := importLine{
+			path: dep.Path(),
+			// field 3 of FileDescriptorProto is dependency
+			location: ff.SourceLocations().ByPath(protoreflect.SourcePath{3, int32(idx)}),
+		}
+
+		if dep.IsPublic {
+			line.modifier = "public "
+		} else if dep.IsWeak {
+			line.modifier = "weak "
+		}
+
+		if options.GroupImports {
+			if strings.HasPrefix(line.path, "google/") {
+				line.group = importGroupWellKnown
+			} else if _, ok := localFiles[line.path]; ok {
+				line.group = importGroupLocal
+			} else {
+				line.group = importGroupExternal
+			}
+		}
+
+		lines = append(lines, line)
+	}
+
+	sort.SliceStable(lines, func(i, j int) bool {
+		if lines[i].group != lines[j].group {
+			return lines[i].group < lines[j].group
+		}
+		return lines[i].path < lines[j].path
+	})
+
+	for idx, line := range lines {
+		if idx > 0 && line.group != lines[idx-1].group {
+			fb.addGap()
+		}
+		fb.leadingComments(line.location)
+		fb.p("import ", line.modifier, "\"", line.path, "\";", inlineComment(line.location))
+		fb.trailingComments(line.location)
+	}
+	fb.addGap()
+}
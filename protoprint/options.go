@@ -10,10 +10,22 @@ import (
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
-var maxExtDepth = map[protoreflect.FullName]int{
-	"google.api.http": 0,
-	//"buf.validate.field": 1,
-}
+// OptionOrder is the order options are printed in, for option statements and
+// for the options of fields and enum values alike.
+type OptionOrder int
+
+const (
+	// OptionOrderSource keeps the order options were written in. Options
+	// without a source location follow, in field number order.
+	OptionOrderSource OptionOrder = iota
+
+	// OptionOrderAlphabetical sorts options by their name as printed.
+	OptionOrderAlphabetical
+
+	// OptionOrderFieldNumber sorts options by the field number of the option,
+	// which puts the built in options before extensions.
+	OptionOrderFieldNumber
+)
 
 type parsedOption struct {
 	def           *optionreflect.OptionDefinition
@@ -21,41 +33,110 @@ type parsedOption struct {
 	inline        bool
 	inlineString  *string
 	qualifiedName string
+
+	// rawValue is the value as written in the source, for options which
+	// could not be decoded and span multiple lines.
+	rawValue []string
+
+	// comments are the comments of the option statement, or of the option
+	// in a field's option list.
+	comments protoreflect.SourceLocation
+
+	// span is the source span of the option, nil when unknown.
+	span []int32
+
+	// pseudo is set for 'default' and 'json_name', which are printed as
+	// options but are fields of the descriptor.
+	pseudo bool
 }
 
-func optionFullName(opt *optionreflect.OptionDefinition) string {
+// number is the field number of the option, in its options message.
+func (po parsedOption) number() int {
+	switch {
+	case po.pseudo:
+		return 0
+	case po.def.Unresolved != nil:
+		return int(po.def.Unresolved.Number)
+	default:
+		return int(po.def.RootType.Number())
+	}
+}
 
-	name, err := contextRefName(opt.Context, opt.RootType)
-	if err != nil {
-		panic(err.Error())
+func (po parsedOption) hasComments() bool {
+	return po.comments.LeadingComments != "" || po.comments.TrailingComments != "" ||
+		len(po.comments.LeadingDetachedComments) > 0 || po.root.HasComments()
+}
+
+func optionSpan(opt *optionreflect.OptionDefinition) []int32 {
+	if opt.SourceLocation == nil || opt.SourceLocation.Src == nil {
+		return nil
+	}
+	return opt.SourceLocation.Src.Span
+}
+
+func optionComments(opt *optionreflect.OptionDefinition) protoreflect.SourceLocation {
+	if opt.SourceLocation == nil || opt.SourceLocation.Src == nil {
+		return protoreflect.SourceLocation{}
+	}
+	src := opt.SourceLocation.Src
+	return protoreflect.SourceLocation{
+		LeadingDetachedComments: src.LeadingDetachedComments,
+		LeadingComments:         src.GetLeadingComments(),
+		TrailingComments:        src.GetTrailingComments(),
+	}
+}
+
+func (fb *fileBuilder) optionFullName(opt *optionreflect.OptionDefinition) string {
+
+	if !opt.RootType.IsExtension() {
+		// Built in options are not wrapped in brackets
+		return opt.FullType()
 	}
 
+	name := fb.refName(optionScope(opt.Context), opt.RootType, false)
+
 	if len(opt.SubPath) == 0 {
 		return fmt.Sprintf("(%s)", name)
 	}
 
 	return fmt.Sprintf("(%s).%s", name, strings.Join(opt.SubPath, "."))
 }
-func parseOption(opt *optionreflect.OptionDefinition) parsedOption {
 
-	maxDepth, ok := maxExtDepth[opt.Desc.FullName()]
-	if !ok {
-		maxDepth = 5
+// optionScope is the scope option names of the element are resolved in,
+// which for messages and services is the scope they are declared in, not
+// their own.
+func optionScope(element protoreflect.Descriptor) protoreflect.Descriptor {
+	if _, ok := element.(protoreflect.FileDescriptor); ok {
+		return element
 	}
-	simplify := true
+	scope := element.Parent()
+	for {
+		switch scope.(type) {
+		case protoreflect.FileDescriptor, protoreflect.MessageDescriptor, protoreflect.ServiceDescriptor:
+			return scope
+		}
+		scope = scope.Parent()
+	}
+}
 
-	// convention seems to dictate these are always specified as
-	// (google.api.http) = { ... }
-	// even if it's just a get.
-	if opt.Desc.FullName() == "google.api.http" {
-		simplify = false
+func (fb *fileBuilder) parseOption(opt *optionreflect.OptionDefinition) (parsedOption, error) {
+	if opt.Unresolved != nil {
+		return fb.parseUnresolved(opt), nil
 	}
 
-	if simplify {
-		opt.Simplify(maxDepth)
+	policy := fb.out.printer.options.Policy.optionPolicy(opt.RootType.FullName())
+
+	// Options split by statement already have the shape they were written
+	// with.
+	if !opt.AsWritten && !policy.Aggregate {
+		opt.Simplify(policy.simplifyDepth())
 	}
 
-	root := optionreflect.WalkOptionField(opt.Desc, opt.Value)
+	root, err := opt.Walk()
+	if err != nil {
+		return parsedOption{}, fmt.Errorf("option %s: %w", opt.FullType(), err)
+	}
+	policy.orderFields(&root)
 
 	sourceSingleLine := opt.SourceLocation == nil || opt.SourceLocation.SingleLine
 	inlineWithParent := opt.SourceLocation == nil || opt.SourceLocation.InLineWithParent
@@ -64,115 +145,361 @@ func parseOption(opt *optionreflect.OptionDefinition) parsedOption {
 		root:          root,
 		def:           opt,
 		inline:        inlineWithParent,
-		qualifiedName: optionFullName(opt),
+		qualifiedName: fb.optionFullName(opt),
+		comments:      optionComments(opt),
+		span:          optionSpan(opt),
+	}
+
+	if root.FieldType == optionreflect.FieldTypeMessage {
+		if inline, ok := policy.inlineLiteral(root, sourceSingleLine); ok {
+			parsed.inlineString = proto.String(inline)
+		}
+		return parsed, nil
 	}
 
 	if !sourceSingleLine {
-		return parsed
+		return parsed, nil
 	}
 
 	switch root.FieldType {
-	case optionreflect.FieldTypeMessage:
-		if len(root.Children) == 0 {
-			parsed.inlineString = proto.String("{}")
-			return parsed
-		}
-		if len(root.Children) == 1 {
-			child := root.Children[0]
-			if child.FieldType == optionreflect.FieldTypeScalar {
-				parsed.inlineString = proto.String(fmt.Sprintf("{%s: %s}", child.Key, child.ScalarValue))
-				return parsed
-			}
-		}
-		return parsed
 	case optionreflect.FieldTypeArray:
 
 		if len(root.Children) == 0 {
 			parsed.inlineString = proto.String("[]")
-			return parsed
+			return parsed, nil
 		}
-		return parsed
+		return parsed, nil
 
 	case optionreflect.FieldTypeScalar:
 		parsed.inlineString = proto.String(root.ScalarValue)
-		return parsed
+		return parsed, nil
 
 	default:
-		panic(fmt.Sprintf("unexpected type %v", root.FieldType))
+		return parsedOption{}, fmt.Errorf("option %s: unexpected type %v", opt.FullType(), root.FieldType)
 	}
 }
 
-func (fb *fileBuilder) optionsFor(thing protoreflect.Descriptor) ([]parsedOption, error) {
-
-	options, err := fb.out.extensions.OptionsFor(thing)
+// optionDefinitions returns the options defined on the descriptor, with the
+// feature set split into one option per feature. Features which are the same as
+// those inherited from the parent are dropped.
+func (fb *fileBuilder) optionDefinitions(thing protoreflect.Descriptor) ([]*optionreflect.OptionDefinition, error) {
+	options, err := fb.out.printer.extensions.OptionsFor(thing)
 	if err != nil {
 		return nil, err
 	}
+	return fb.splitDefinitions(thing, optionreflect.FeatureParent(thing), options)
+}
 
-	parsed := make([]parsedOption, 0, len(options))
+// splitDefinitions splits the options of the element into the definitions
+// which are printed. Features are compared with those of the feature parent,
+// or the edition defaults when it is nil.
+func (fb *fileBuilder) splitDefinitions(thing, featureParent protoreflect.Descriptor, options []*optionreflect.OptionDefinition) ([]*optionreflect.OptionDefinition, error) {
+	out := make([]*optionreflect.OptionDefinition, 0, len(options))
 	for _, opt := range options {
-		parsed = append(parsed, parseOption(opt))
+		if opt.Unresolved != nil {
+			out = append(out, fb.unresolvedOptions(thing, opt)...)
+			continue
+		}
+
+		if fb.out.printer.options.PreserveOptionShape {
+			if statements, ok := opt.SplitStatements(); ok {
+				out = append(out, statements...)
+				continue
+			}
+		}
+
+		if opt.Desc.IsList() {
+			// There is no list syntax for options, each item is specified
+			// separately.
+			out = append(out, opt.ListItems()...)
+			continue
+		}
+
+		if opt.RootType.IsExtension() || opt.RootType.Name() != "features" {
+			out = append(out, opt)
+			continue
+		}
+
+		features, err := featureOptions(thing.ParentFile(), featureParent, opt)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, features...)
 	}
 
-	slices.SortFunc(parsed, func(i, j parsedOption) int {
-		if i.qualifiedName < j.qualifiedName {
-			return -1
+	return out, nil
+}
+
+func featureOptions(file protoreflect.FileDescriptor, parent protoreflect.Descriptor, opt *optionreflect.OptionDefinition) ([]*optionreflect.OptionDefinition, error) {
+	var inherited protoreflect.Message
+	if parent != nil {
+		parentFeatures, err := optionreflect.ResolvedFeatures(parent)
+		if err != nil {
+			return nil, err
 		}
-		if i.qualifiedName > j.qualifiedName {
-			return 1
+		inherited = parentFeatures.ProtoReflect()
+	} else {
+		defaults, err := optionreflect.EditionDefaults(optionreflect.FileEdition(file))
+		if err != nil {
+			return nil, err
 		}
-		return 0
+		inherited = defaults.ProtoReflect()
+	}
+
+	features := make([]*optionreflect.OptionDefinition, 0)
+	opt.Value.Message().Range(func(field protoreflect.FieldDescriptor, val protoreflect.Value) bool {
+		if inheritedField := inherited.Descriptor().Fields().ByNumber(field.Number()); inheritedField != nil && !field.IsExtension() {
+			if inherited.Has(inheritedField) && inherited.Get(inheritedField).Equal(val) {
+				return true
+			}
+		}
+
+		name := string(field.Name())
+		if field.IsExtension() {
+			name = fmt.Sprintf("(%s)", field.FullName())
+		}
+
+		features = append(features, &optionreflect.OptionDefinition{
+			Context:        opt.Context,
+			RootType:       opt.RootType,
+			SubPath:        append(slices.Clone(opt.SubPath), name),
+			Desc:           field,
+			Value:          val,
+			SourceLocation: opt.SourceLocation,
+		})
+		return true
 	})
 
+	slices.SortStableFunc(features, func(a, b *optionreflect.OptionDefinition) int {
+		return int(a.Desc.Number()) - int(b.Desc.Number())
+	})
+
+	return features, nil
+}
+
+func (fb *fileBuilder) optionsFor(thing protoreflect.Descriptor) ([]parsedOption, error) {
+
+	options, err := fb.optionDefinitions(thing)
+	if err != nil {
+		return nil, elementError(thing, err)
+	}
+	return fb.parseOptions(options)
+}
+
+// extensionRangeOptions returns the options of the message's extension range
+// at the index. Their features are inherited from the message.
+func (fb *fileBuilder) extensionRangeOptions(msg protoreflect.MessageDescriptor, idx int) ([]parsedOption, error) {
+	definitions, err := fb.out.printer.extensions.ExtensionRangeOptionsFor(msg, idx)
+	if err != nil {
+		return nil, elementError(msg, err)
+	}
+	options, err := fb.splitDefinitions(msg, msg, definitions)
+	if err != nil {
+		return nil, elementError(msg, err)
+	}
+	return fb.parseOptions(options)
+}
+
+func (fb *fileBuilder) parseOptions(options []*optionreflect.OptionDefinition) ([]parsedOption, error) {
+	parsed := make([]parsedOption, 0, len(options))
+	for _, opt := range options {
+		option, err := fb.parseOption(opt)
+		if err != nil {
+			return nil, optionError(opt, err)
+		}
+		parsed = append(parsed, option)
+	}
+
+	fb.sortOptions(parsed)
 	return parsed, nil
 }
 
-func (extInd *fileBuilder) printOption(opt *optionreflect.OptionDefinition) {
+// sortOptions sorts options by the OptionOrder of the printer. The pseudo
+// options of fields lead, except in source order where they are placed as
+// they were written.
+func (fb *fileBuilder) sortOptions(options []parsedOption) {
+	switch fb.out.printer.options.OptionOrder {
+	case OptionOrderAlphabetical:
+		slices.SortStableFunc(options, func(a, b parsedOption) int {
+			if a.pseudo != b.pseudo {
+				return boolOrder(a.pseudo, b.pseudo)
+			}
+			return strings.Compare(a.qualifiedName, b.qualifiedName)
+		})
+
+	case OptionOrderFieldNumber:
+		slices.SortStableFunc(options, func(a, b parsedOption) int {
+			if a.pseudo != b.pseudo {
+				return boolOrder(a.pseudo, b.pseudo)
+			}
+			return a.number() - b.number()
+		})
+
+	default:
+		slices.SortStableFunc(options, func(a, b parsedOption) int {
+			if (a.span == nil) != (b.span == nil) {
+				return boolOrder(a.span != nil, b.span != nil)
+			}
+			if a.span == nil {
+				return a.number() - b.number()
+			}
+			if a.span[0] != b.span[0] {
+				return int(a.span[0] - b.span[0])
+			}
+			return int(a.span[1] - b.span[1])
+		})
+	}
+}
+
+// boolOrder orders true before false.
+func boolOrder(a, b bool) int {
+	if a == b {
+		return 0
+	}
+	if a {
+		return -1
+	}
+	return 1
+}
+
+// fieldOptions returns the options for a field-style element, including
+// pseudo-options like 'default' which are stored on the descriptor itself.
+func (fb *fileBuilder) fieldOptions(elem protoreflect.Descriptor) ([]parsedOption, error) {
+	options, err := fb.optionsFor(elem)
+	if err != nil {
+		return nil, err
+	}
+
+	field, ok := elem.(protoreflect.FieldDescriptor)
+	if !ok {
+		return options, nil
+	}
+
+	// The pseudo-options are fields of the FieldDescriptorProto, with their
+	// own source locations.
+	fieldLoc := field.ParentFile().SourceLocations().ByDescriptor(field)
+	pseudoLocation := func(number int32) (protoreflect.SourceLocation, []int32) {
+		if fieldLoc.Path == nil {
+			return protoreflect.SourceLocation{}, nil
+		}
+		loc := field.ParentFile().SourceLocations().ByPath(append(slices.Clone(fieldLoc.Path), number))
+		if loc.Path == nil {
+			return loc, nil
+		}
+		return loc, []int32{int32(loc.StartLine), int32(loc.StartColumn)}
+	}
+
+	pseudo := make([]parsedOption, 0)
+	if field.HasDefault() {
+		root, err := optionreflect.WalkOptionField(field, field.Default())
+		if err != nil {
+			return nil, elementError(field, fmt.Errorf("default: %w", err))
+		}
+		comments, span := pseudoLocation(7) // default_value
+		pseudo = append(pseudo, parsedOption{
+			root:          root,
+			inline:        true,
+			inlineString:  proto.String(root.ScalarValue),
+			qualifiedName: "default",
+			comments:      comments,
+			span:          span,
+			pseudo:        true,
+		})
+	}
+
+	// Compilers set json_name for every field, so it is only printed when it
+	// differs from the default.
+	if !field.IsExtension() && field.HasJSONName() && field.JSONName() != jsonCamelCase(string(field.Name())) {
+		comments, span := pseudoLocation(10) // json_name
+		pseudo = append(pseudo, parsedOption{
+			root: optionreflect.OptionField{
+				FieldType:   optionreflect.FieldTypeScalar,
+				Key:         "json_name",
+				ScalarValue: optionreflect.QuoteString(field.JSONName()),
+			},
+			inline:        true,
+			inlineString:  proto.String(optionreflect.QuoteString(field.JSONName())),
+			qualifiedName: "json_name",
+			comments:      comments,
+			span:          span,
+			pseudo:        true,
+		})
+	}
+
+	options = append(pseudo, options...)
+	fb.sortOptions(options)
+	return options, nil
+}
+
+func (extInd *fileBuilder) printOption(parsed parsedOption) {
 
-	parsed := parseOption(opt)
+	srcLoc := parsed.comments
+	extInd.leadingComments(srcLoc)
+	defer extInd.trailingComments(srcLoc)
 
 	typeName := parsed.qualifiedName
+	if parsed.rawValue != nil {
+		extInd.printRawValue("option "+typeName+" = ", parsed.rawValue, ";", inlineComment(srcLoc))
+		return
+	}
 	if parsed.inlineString != nil {
-		extInd.p("option ", typeName, " = ", *parsed.inlineString, ";")
+		extInd.p("option ", typeName, " = ", *parsed.inlineString, ";", inlineComment(srcLoc))
 		return
 	}
 
 	switch parsed.root.FieldType {
 	case optionreflect.FieldTypeMessage:
 		if len(parsed.root.Children) == 0 {
-			extInd.p("option ", typeName, " = {};")
+			extInd.p("option ", typeName, " = {};", inlineComment(srcLoc))
+			return
 		}
 		extInd.p("option ", typeName, " = {")
 		extInd.printOptionMessageFields(parsed.root.Children)
-		extInd.endElem("};")
+		extInd.endElem("};", inlineComment(srcLoc))
 
 	case optionreflect.FieldTypeArray:
 		opener := fmt.Sprintf("option %s", typeName)
 		extInd.printOptionArray(opener+" = ", parsed.root.Children, ";")
 
 	case optionreflect.FieldTypeScalar:
-		extInd.p("option ", typeName, " = ", parsed.root.ScalarValue, ";")
+		extInd.p("option ", typeName, " = ", parsed.root.ScalarValue, ";", inlineComment(srcLoc))
 
 	}
 
 }
 
+// printRawValue prints a multi-line value as it was written in the source.
+func (ind *fileBuilder) printRawValue(opener string, lines []string, trailer ...interface{}) {
+	ind.p(opener, lines[0])
+	for _, line := range lines[1 : len(lines)-1] {
+		ind.p(line)
+	}
+	ind.p(append([]interface{}{lines[len(lines)-1]}, trailer...)...)
+}
+
 func (ind *fileBuilder) printOptionArray(opener string, children []optionreflect.OptionField, trailer string) {
 	if len(children) == 0 {
 		ind.p(opener, "[]", trailer)
 		return
 	}
-	if len(children) == 1 && children[0].FieldType == optionreflect.FieldTypeScalar {
+	if len(children) == 1 && children[0].FieldType == optionreflect.FieldTypeScalar && !children[0].HasComments() {
 		ind.p(opener, "[", children[0].ScalarValue, "]", trailer)
 		return
 	}
 	if children[0].FieldType == optionreflect.FieldTypeMessage {
+		// There is no line for the item itself, its comments are kept
+		// inside the braces.
 		ind.p(opener, "[{")
+		ind2 := ind.indent()
 		for idx, child := range children {
 			if idx != 0 {
 				ind.p("}, {")
 			}
+			ind2.literalComments(child.LeadingDetachedComments, child.LeadingComments)
 			ind.printOptionMessageFields(child.Children)
+			if child.TrailingComments != "" {
+				ind2.literalComments(nil, child.TrailingComments)
+			}
 		}
 		ind.endElem("}]", trailer)
 		return
@@ -184,7 +511,8 @@ func (ind *fileBuilder) printOptionArray(opener string, children []optionreflect
 		if idx != len(children)-1 {
 			lineTrail = ","
 		}
-		ind2.p(child.ScalarValue, lineTrail)
+		ind2.literalComments(child.LeadingDetachedComments, child.LeadingComments)
+		ind2.p(child.ScalarValue, literalTrailer(child.TrailingComments, lineTrail))
 	}
 	ind.endElem("]", trailer)
 }
@@ -192,38 +520,75 @@ func (ind *fileBuilder) printOptionArray(opener string, children []optionreflect
 func (ind *fileBuilder) printOptionMessageFields(children []optionreflect.OptionField) {
 	ind2 := ind.indent()
 	for _, child := range children {
+		ind2.literalComments(child.LeadingDetachedComments, child.LeadingComments)
+		trailer := literalTrailer(child.TrailingComments, "")
 		switch child.FieldType {
 		case optionreflect.FieldTypeMessage:
 			ind2.p(child.Key, ": {")
 			ind2.printOptionMessageFields(child.Children)
-			ind2.endElem("}")
+			ind2.endElem("}", trailer)
 		case optionreflect.FieldTypeArray:
-			ind2.printOptionArray(child.Key+": ", child.Children, "")
+			ind2.printOptionArray(child.Key+": ", child.Children, trailer)
 		case optionreflect.FieldTypeScalar:
-			ind2.p(child.Key, ": ", child.ScalarValue)
+			ind2.p(child.Key, ": ", child.ScalarValue, trailer)
 		}
 	}
 
 }
 
+// literalComments prints comments leading a line inside an option value or a
+// field's option list. Unlike elements, there is no gap before the comment,
+// only around detached comments.
+func (ind *fileBuilder) literalComments(detached []string, leading string) {
+	for _, comment := range detached {
+		ind.addGap()
+		for _, part := range commentLines(comment) {
+			ind.p(part)
+		}
+		ind.addGap()
+	}
+	for _, part := range commentLines(leading) {
+		ind.p(part)
+	}
+}
+
+// literalTrailer ends a line inside an option value with the separator and
+// the trailing comment.
+func literalTrailer(comment string, separator string) string {
+	text := strings.TrimSuffix(comment, "\n")
+	if text == "" {
+		return separator
+	}
+	// block comments end in a space before the */
+	text = strings.TrimRight(strings.ReplaceAll(text, "\n", " "), " ")
+	return separator + " //" + text
+}
+
 func (fb *fileBuilder) printFieldStyle(name string, number int32, elem protoreflect.Descriptor) error {
 
 	srcLoc := elem.ParentFile().SourceLocations().ByDescriptor(elem)
 
-	options, err := fb.optionsFor(elem)
+	options, err := fb.fieldOptions(elem)
 	if err != nil {
 		return err
 	}
 
+	fb.printWithOptions(fmt.Sprintf("%s = %d", name, number), options, srcLoc)
+	return nil
+}
+
+// printWithOptions prints a statement which takes its options in brackets,
+// like a field or an extension range.
+func (fb *fileBuilder) printWithOptions(statement string, options []parsedOption, srcLoc protoreflect.SourceLocation) {
 	fb.leadingComments(srcLoc)
 
 	if len(options) == 0 {
-		fb.p(name, " = ", number, ";", inlineComment(srcLoc))
-	} else if len(options) == 1 && options[0].inline && options[0].inlineString != nil {
+		fb.p(statement, ";", inlineComment(srcLoc))
+	} else if len(options) == 1 && options[0].inline && options[0].inlineString != nil && !options[0].hasComments() {
 		opt := options[0]
-		fb.p(name, " = ", number, " [", opt.qualifiedName, " = ", *opt.inlineString, "];", inlineComment(srcLoc))
+		fb.p(statement, " [", opt.qualifiedName, " = ", *opt.inlineString, "];", inlineComment(srcLoc))
 	} else {
-		fb.p(name, " = ", number, " [", inlineComment(srcLoc))
+		fb.p(statement, " [")
 		extInd := fb.indent()
 		for idx, parsed := range options {
 			trailer := ","
@@ -232,6 +597,14 @@ func (fb *fileBuilder) printFieldStyle(name string, number int32, elem protorefl
 			}
 			val := parsed.root
 
+			extInd.literalComments(parsed.comments.LeadingDetachedComments, parsed.comments.LeadingComments)
+			trailer = literalTrailer(parsed.comments.TrailingComments, trailer)
+
+			if parsed.rawValue != nil {
+				extInd.printRawValue(parsed.qualifiedName+" = ", parsed.rawValue, trailer)
+				continue
+			}
+
 			if parsed.inlineString != nil {
 				extInd.p(parsed.qualifiedName, " = ", *parsed.inlineString, trailer)
 				continue
@@ -251,6 +624,21 @@ func (fb *fileBuilder) printFieldStyle(name string, number int32, elem protorefl
 		fb.endElem("];", inlineComment(srcLoc))
 	}
 	fb.trailingComments(srcLoc)
+}
 
-	return nil
+// jsonCamelCase is the default json_name for a field, as defined by protoc.
+func jsonCamelCase(name string) string {
+	out := make([]byte, 0, len(name))
+	wasUnderscore := false
+	for idx := 0; idx < len(name); idx++ {
+		c := name[idx]
+		if c != '_' {
+			if wasUnderscore && 'a' <= c && c <= 'z' {
+				c -= 'a' - 'A'
+			}
+			out = append(out, c)
+		}
+		wasUnderscore = c == '_'
+	}
+	return string(out)
 }
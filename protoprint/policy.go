@@ -0,0 +1,183 @@
+package protoprint
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/pentops/prototools/optionreflect"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"gopkg.in/yaml.v2"
+)
+
+// PolicyFilename is the name of the policy file, which lives next to buf.yaml.
+const PolicyFilename = "protoprint.yaml"
+
+// Policy controls how option values are printed, by the full name of the
+// option field, e.g. 'google.api.http' or 'buf.validate.field'.
+//
+//	options:
+//	  buf.validate.field:
+//	    maxDepth: 1
+//	  j5.ext.v1.field:
+//	    inlineFields: 2
+//	    fieldOrder: name
+type Policy struct {
+	Options map[string]OptionPolicy `yaml:"options"`
+}
+
+// OptionPolicy controls how the value of one option is printed.
+type OptionPolicy struct {
+	// MaxDepth is how far the option is simplified into a path, e.g. `option
+	// (a).b.c = 1;` has a depth of 2. When nil the depth is 6.
+	MaxDepth *int `yaml:"maxDepth"`
+
+	// Aggregate always prints the option as a literal, e.g. `option (a) = {
+	// b: {c: 1} };`, however few fields are set.
+	Aggregate bool `yaml:"aggregate"`
+
+	// InlineFields is the most fields a literal of only scalar fields can have
+	// to be printed on one line, as `{a: 1, b: 2}`. When nil, a literal with one
+	// field is printed on one line when it was written on one line.
+	InlineFields *int `yaml:"inlineFields"`
+
+	// FieldOrder is the order of the fields within literals.
+	FieldOrder LiteralFieldOrder `yaml:"fieldOrder"`
+}
+
+// LiteralFieldOrder is the order fields are printed in within an option
+// literal.
+type LiteralFieldOrder string
+
+const (
+	// LiteralFieldOrderDeclaration follows the order the fields are declared
+	// in the message, the default.
+	LiteralFieldOrderDeclaration LiteralFieldOrder = ""
+
+	// LiteralFieldOrderNumber sorts fields by field number.
+	LiteralFieldOrderNumber LiteralFieldOrder = "number"
+
+	// LiteralFieldOrderName sorts fields by name.
+	LiteralFieldOrderName LiteralFieldOrder = "name"
+)
+
+const defaultMaxDepth = 6
+
+// DefaultPolicy holds the conventions for well known options, which are used
+// when Options.Policy is nil, and by LoadPolicy for options the file does not
+// mention.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Options: map[string]OptionPolicy{
+			// convention seems to dictate these are always specified as
+			// (google.api.http) = { ... }
+			// even if it's just a get.
+			"google.api.http": {Aggregate: true},
+		},
+	}
+}
+
+// ParsePolicy parses a policy file, adding the file's options to the
+// DefaultPolicy.
+func ParsePolicy(data []byte) (*Policy, error) {
+	file := &Policy{}
+	if err := yaml.UnmarshalStrict(data, file); err != nil {
+		return nil, fmt.Errorf("parsing policy: %w", err)
+	}
+
+	policy := DefaultPolicy()
+	for name, opt := range file.Options {
+		if err := opt.validate(); err != nil {
+			return nil, fmt.Errorf("policy for %s: %w", name, err)
+		}
+		policy.Options[name] = opt
+	}
+	return policy, nil
+}
+
+// LoadPolicy reads PolicyFilename from the directory, returning the
+// DefaultPolicy when there is no file.
+func LoadPolicy(root fs.FS, dir string) (*Policy, error) {
+	data, err := fs.ReadFile(root, path.Join(dir, PolicyFilename))
+	if errors.Is(err, fs.ErrNotExist) {
+		return DefaultPolicy(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+func (op OptionPolicy) validate() error {
+	switch op.FieldOrder {
+	case LiteralFieldOrderDeclaration, LiteralFieldOrderNumber, LiteralFieldOrderName:
+	default:
+		return fmt.Errorf("unknown field order %q", op.FieldOrder)
+	}
+	if op.MaxDepth != nil && *op.MaxDepth < 0 {
+		return fmt.Errorf("maxDepth must not be negative")
+	}
+	if op.InlineFields != nil && *op.InlineFields < 0 {
+		return fmt.Errorf("inlineFields must not be negative")
+	}
+	return nil
+}
+
+func (p *Policy) optionPolicy(name protoreflect.FullName) OptionPolicy {
+	if p == nil {
+		p = DefaultPolicy()
+	}
+	return p.Options[string(name)]
+}
+
+// simplifyDepth is the depth for OptionDefinition.Simplify, which stops once
+// the path is longer than its depth.
+func (op OptionPolicy) simplifyDepth() int {
+	if op.MaxDepth == nil {
+		return defaultMaxDepth - 1
+	}
+	return *op.MaxDepth - 1
+}
+
+// inlineLiteral returns the literal on one line, when the policy allows it.
+func (op OptionPolicy) inlineLiteral(root optionreflect.OptionField, sourceSingleLine bool) (string, bool) {
+	limit := 1
+	if op.InlineFields != nil {
+		limit = *op.InlineFields
+	} else if !sourceSingleLine {
+		return "", false
+	}
+
+	if len(root.Children) > limit || root.HasComments() {
+		return "", false
+	}
+	fields := make([]string, 0, len(root.Children))
+	for _, child := range root.Children {
+		if child.FieldType != optionreflect.FieldTypeScalar {
+			return "", false
+		}
+		fields = append(fields, fmt.Sprintf("%s: %s", child.Key, child.ScalarValue))
+	}
+	return "{" + strings.Join(fields, ", ") + "}", true
+}
+
+// orderFields sorts the fields of literals within the value.
+func (op OptionPolicy) orderFields(field *optionreflect.OptionField) {
+	if op.FieldOrder == LiteralFieldOrderDeclaration {
+		return
+	}
+	if field.FieldType == optionreflect.FieldTypeMessage {
+		slices.SortStableFunc(field.Children, func(a, b optionreflect.OptionField) int {
+			if op.FieldOrder == LiteralFieldOrderName {
+				return strings.Compare(a.Key, b.Key)
+			}
+			return int(a.FieldNumber) - int(b.FieldNumber)
+		})
+	}
+	for idx := range field.Children {
+		op.orderFields(&field.Children[idx])
+	}
+}
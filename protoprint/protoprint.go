@@ -5,9 +5,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sort"
+	"io/fs"
+	"path"
+	"runtime"
 	"strings"
+	"sync"
 
+	"github.com/pentops/log.go/log"
 	"github.com/pentops/prototools/optionreflect"
 	"google.golang.org/protobuf/reflect/protodesc"
 	"google.golang.org/protobuf/reflect/protoreflect"
@@ -16,8 +20,112 @@ import (
 )
 
 type Options struct {
+	// PackagePrefixes limits the printed files to those in packages starting
+	// with one of the prefixes, by whole package segments, so 'foo.v1'
+	// matches 'foo.v1' and 'foo.v1.bar' but not 'foo.v10'.
 	PackagePrefixes []string
-	OnlyFilenames   []string
+
+	// OnlyFilenames limits the printed files to those listed, which may be
+	// path.Match glob patterns like 'foo/v1/*.proto'. When set along with
+	// PackagePrefixes, files must match both.
+	//
+	// Files which are not printed are still used to resolve options and
+	// references.
+	OnlyFilenames []string
+
+	// GroupImports splits imports into separate blocks for well known google/
+	// imports, external dependencies and files from the local module, which
+	// are the files passed in to be printed.
+	GroupImports bool
+
+	// Lenient prints files which use extension options that can't be
+	// resolved, rather than failing. Those options are printed as they were
+	// written in Source, or dropped when the source is not available, with a
+	// warning either way.
+	Lenient bool
+
+	// Source holds the .proto files the descriptors were compiled from, by
+	// file path.
+	Source fs.FS
+
+	// OnWarning receives problems which did not stop a file being printed.
+	// When nil, warnings are logged.
+	OnWarning func(Warning)
+
+	// ExtensionTypes are used to decode options, in addition to the
+	// extensions declared in the printed files and their imports. They take
+	// precedence over the declared extensions.
+	ExtensionTypes *protoregistry.Types
+
+	// Verify compiles each printed file and fails if it does not describe the
+	// same file as the original, see Verify.
+	Verify bool
+
+	// OptionOrder is the order the options of each element are printed in,
+	// the zero value keeps the order of the source.
+	OptionOrder OptionOrder
+
+	// PreserveOptionShape prints options with the statements they were
+	// written as, so `option (a).b = 1;` stays dotted and `option (a) = {b:
+	// 1};` stays a literal, where otherwise the printer picks the shape.
+	// Values are still formatted within each statement. Options without
+	// source info are printed as usual.
+	PreserveOptionShape bool
+
+	// Policy controls how the values of options are printed, by option. When
+	// nil, the DefaultPolicy is used.
+	Policy *Policy
+
+	// Concurrency is the most files printed at once, when zero or less it is
+	// GOMAXPROCS. Files are still passed to the FileWriter one at a time, in
+	// the order given, and warnings are reported in that order.
+	Concurrency int
+}
+
+// Warning is a problem which did not stop a file being printed, but means the
+// output may not match the descriptor.
+type Warning struct {
+	Filename string
+	Element  protoreflect.FullName
+	Message  string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s: %s", w.Filename, w.Element, w.Message)
+}
+
+// includeFile returns true when the file passes the PackagePrefixes and
+// OnlyFilenames filters.
+func (opts Options) includeFile(file protoreflect.FileDescriptor) bool {
+	if len(opts.PackagePrefixes) > 0 {
+		pkg := string(file.Package())
+		matched := false
+		for _, prefix := range opts.PackagePrefixes {
+			prefix = strings.TrimSuffix(prefix, ".")
+			if pkg == prefix || strings.HasPrefix(pkg, prefix+".") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(opts.OnlyFilenames) > 0 {
+		matched := false
+		for _, pattern := range opts.OnlyFilenames {
+			if ok, err := path.Match(pattern, file.Path()); pattern == file.Path() || (err == nil && ok) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
 }
 
 type FileWriter interface {
@@ -27,6 +135,9 @@ type FileWriter interface {
 type mapResolver struct {
 	descriptors map[string]*descriptorpb.FileDescriptorProto
 	built       map[string]protoreflect.FileDescriptor
+
+	// allowUnresolvable builds files which import files not in the set
+	allowUnresolvable bool
 }
 
 func (r *mapResolver) FindFileByPath(path string) (protoreflect.FileDescriptor, error) {
@@ -34,7 +145,7 @@ func (r *mapResolver) FindFileByPath(path string) (protoreflect.FileDescriptor,
 		return file, nil
 	}
 	if file, ok := r.descriptors[path]; ok {
-		fd, err := protodesc.NewFile(file, r)
+		fd, err := protodesc.FileOptions{AllowUnresolvable: r.allowUnresolvable}.New(file, r)
 		if err != nil {
 			return nil, err
 		}
@@ -49,90 +160,70 @@ func (r *mapResolver) FindDescriptorByName(message protoreflect.FullName) (proto
 }
 
 func PrintFile(ctx context.Context, file protoreflect.FileDescriptor) (string, error) {
-	fileData, err := printFile(file, nil)
+	printer := newFilePrinter(ctx, Options{}, extensionBuilder([]protoreflect.FileDescriptor{file}, nil))
+	fileData, err := printer.printFile(file)
 	if err != nil {
-		return "", fmt.Errorf("in file %s: %w", file.Path(), err)
+		return "", fileError(file, err)
 	}
 	return string(fileData), nil
 }
 
 func PrintReflect(ctx context.Context, out FileWriter, descriptors []protoreflect.FileDescriptor, opts Options) error {
-	for _, file := range descriptors {
-		fileData, err := printFile(file, nil)
-		if err != nil {
-			return fmt.Errorf("in file %s: %w", file.Path(), err)
-		}
-
-		if err := out.PutFile(ctx, file.Path(), fileData); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	printer := newFilePrinter(ctx, opts, extensionBuilder(descriptors, opts.ExtensionTypes))
+	return printer.printFiles(ctx, out, descriptors)
 }
 
 func PrintProtoFiles(ctx context.Context, out FileWriter, src *descriptorpb.FileDescriptorSet, opts Options) error {
-
-	fileMap := make(map[string]struct{})
-	if len(opts.OnlyFilenames) > 0 {
-		for _, filename := range opts.OnlyFilenames {
-			fileMap[filename] = struct{}{}
-		}
-	} else {
-		for _, file := range src.File {
-			fileMap[*file.Name] = struct{}{}
-		}
-	}
-
 	sourceMap := make(map[string]*descriptorpb.FileDescriptorProto)
 	for _, file := range src.File {
 		sourceMap[*file.Name] = file
 	}
 
-	resolver := &mapResolver{descriptors: sourceMap}
+	resolver := &mapResolver{
+		descriptors: sourceMap,
+		built:       make(map[string]protoreflect.FileDescriptor),
+
+		allowUnresolvable: opts.Lenient,
+	}
 	descriptors := make([]protoreflect.FileDescriptor, 0)
 	for _, file := range src.File {
-		descriptor, err := protodesc.NewFile(file, resolver)
+		// built through the resolver so that imports share descriptors
+		descriptor, err := resolver.FindFileByPath(file.GetName())
 		if err != nil {
 			return err
 		}
 		descriptors = append(descriptors, descriptor)
 	}
 
-	foundExtensions := make([]protoreflect.ExtensionDescriptor, 0)
-
-	for _, file := range descriptors {
-		for i := 0; i < file.Extensions().Len(); i++ {
-			foundExtensions = append(foundExtensions, file.Extensions().Get(i))
-		}
-	}
-
-	extBuilder := optionreflect.NewBuilder(foundExtensions)
-
-	for _, file := range descriptors {
-		if _, ok := fileMap[string(file.Path())]; !ok {
-			continue
-		}
-
-		fileData, err := printFile(file, extBuilder)
-		if err != nil {
-			return fmt.Errorf("in file %s: %w", file.Path(), err)
-
-		}
+	printer := newFilePrinter(ctx, opts, extensionBuilder(descriptors, opts.ExtensionTypes))
+	return printer.printFiles(ctx, out, descriptors)
+}
 
-		if err := out.PutFile(ctx, file.Path(), fileData); err != nil {
-			return err
-		}
+// extensionBuilder builds a Builder for the extensions declared in the files
+// and their imports, followed by the given types so that they take precedence.
+func extensionBuilder(files []protoreflect.FileDescriptor, types *protoregistry.Types) *optionreflect.Builder {
+	exts := optionreflect.ImportedExtensions(files...)
+	if types != nil {
+		types.RangeExtensions(func(xt protoreflect.ExtensionType) bool {
+			exts = append(exts, xt.TypeDescriptor())
+			return true
+		})
+	}
+	return optionreflect.NewBuilder(exts)
+}
 
-	}
+type fileBuffer struct {
+	out     *bytes.Buffer
+	addGap  bool
+	printer *filePrinter
 
-	return nil
+	// warnings are held until the file is done, so that files printed at
+	// the same time report in order.
+	warnings []Warning
 }
 
-type fileBuffer struct {
-	out        *bytes.Buffer
-	addGap     bool
-	extensions *optionreflect.Builder
+func (fb *fileBuffer) warn(warning Warning) {
+	fb.warnings = append(fb.warnings, warning)
 }
 
 func (fb *fileBuffer) p(indent int, args ...interface{}) {
@@ -161,14 +252,214 @@ type fileBuilder struct {
 	ind int
 }
 
-func printFile(ff protoreflect.FileDescriptor, exts *optionreflect.Builder) ([]byte, error) {
+// filePrinter holds the configuration shared by all files printed together.
+type filePrinter struct {
+	extensions *optionreflect.Builder
+	options    Options
+	localFiles map[string]struct{}
+	warn       func(Warning)
+
+	// mu guards the caches, which are shared by files printed at once.
+	mu          sync.Mutex
+	sourceLines map[string][]string
+	symbols     map[string]symbols
+	statements  map[string]statementIndex
+}
+
+func newFilePrinter(ctx context.Context, opts Options, exts *optionreflect.Builder) *filePrinter {
+	if opts.Lenient {
+		if exts == nil {
+			exts = optionreflect.NewBuilder(nil)
+		}
+		exts.Lenient = true
+	}
+
+	warn := opts.OnWarning
+	if warn == nil {
+		warn = func(w Warning) {
+			log.WithFields(ctx, map[string]interface{}{
+				"file":    w.Filename,
+				"element": string(w.Element),
+			}).Warn(w.Message)
+		}
+	}
+
+	return &filePrinter{
+		extensions:  exts,
+		options:     opts,
+		localFiles:  make(map[string]struct{}),
+		warn:        warn,
+		sourceLines: make(map[string][]string),
+		symbols:     make(map[string]symbols),
+		statements:  make(map[string]statementIndex),
+	}
+}
+
+// source returns the lines of the source file, or nil when it is not
+// available.
+func (fp *filePrinter) source(filename string) []string {
+	if fp.options.Source == nil {
+		return nil
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if lines, ok := fp.sourceLines[filename]; ok {
+		return lines
+	}
+	var lines []string
+	data, err := fs.ReadFile(fp.options.Source, filename)
+	if err == nil {
+		lines = strings.Split(string(data), "\n")
+	}
+	fp.sourceLines[filename] = lines
+	return lines
+}
+
+func (fp *filePrinter) printFile(ff protoreflect.FileDescriptor) ([]byte, error) {
+	data, warnings, err := fp.printFileWarnings(ff)
+	for _, warning := range warnings {
+		fp.warn(warning)
+	}
+	return data, err
+}
+
+func (fp *filePrinter) printFileWarnings(ff protoreflect.FileDescriptor) ([]byte, []Warning, error) {
 	p := &fileBuilder{
 		out: &fileBuffer{
-			extensions: exts,
-			out:        &bytes.Buffer{},
+			printer: fp,
+			out:     &bytes.Buffer{},
 		},
 	}
-	return p.printFile(ff)
+	data, err := p.printFile(ff)
+	return data, p.out.warnings, err
+}
+
+// printedFile is the result of printing one file.
+type printedFile struct {
+	data     []byte
+	warnings []Warning
+	err      error
+	done     chan struct{}
+}
+
+// printFiles prints the files which pass the filters with a pool of workers,
+// writing them to out in order. A file which fails is not written, and does
+// not stop the others: the errors are joined, in order. Cancelling the
+// context stops the files which have not started.
+//
+// Printing runs at most two files per worker ahead of the writer, so a slow
+// writer, or a slow file, doesn't hold every printed file in memory.
+func (fp *filePrinter) printFiles(ctx context.Context, out FileWriter, descriptors []protoreflect.FileDescriptor) error {
+	// Every file passed in is local, filtered or not, so that the filters
+	// don't change how the printed files group their imports.
+	files := make([]protoreflect.FileDescriptor, 0, len(descriptors))
+	for _, file := range descriptors {
+		fp.localFiles[file.Path()] = struct{}{}
+		if fp.options.includeFile(file) {
+			files = append(files, file)
+		}
+	}
+
+	results := make([]*printedFile, len(files))
+	for idx := range results {
+		results[idx] = &printedFile{done: make(chan struct{})}
+	}
+
+	workers := fp.options.Concurrency
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	workers = min(workers, len(files))
+
+	ctx, cancel := context.WithCancel(ctx)
+	wg := sync.WaitGroup{}
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	// A slot is taken for each file before it is printed, and given back
+	// once it is written.
+	ahead := make(chan struct{}, workers*2)
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for idx := range files {
+			select {
+			case ahead <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case jobs <- idx:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				fp.printWorker(ctx, files[idx], results[idx])
+			}
+		}()
+	}
+
+	errs := make([]error, 0)
+	for idx, file := range files {
+		result := results[idx]
+		select {
+		case <-result.done:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			return errors.Join(append(errs, err)...)
+		}
+
+		for _, warning := range result.warnings {
+			fp.warn(warning)
+		}
+		if result.err != nil {
+			errs = append(errs, result.err)
+		} else if err := out.PutFile(ctx, file.Path(), result.data); err != nil {
+			errs = append(errs, fmt.Errorf("writing %s: %w", file.Path(), err))
+		}
+		results[idx] = nil
+		<-ahead
+	}
+
+	return errors.Join(errs...)
+}
+
+func (fp *filePrinter) printWorker(ctx context.Context, file protoreflect.FileDescriptor, result *printedFile) {
+	defer close(result.done)
+	if err := ctx.Err(); err != nil {
+		result.err = err
+		return
+	}
+
+	data, warnings, err := fp.printFileWarnings(file)
+	result.warnings = warnings
+	if err != nil {
+		result.err = fileError(file, err)
+		return
+	}
+
+	if fp.options.Verify {
+		if err := Verify(ctx, file, data); err != nil {
+			result.err = fileError(file, err)
+			return
+		}
+	}
+	result.data = data
+}
+
+func printFile(ff protoreflect.FileDescriptor, exts *optionreflect.Builder) ([]byte, error) {
+	return newFilePrinter(context.Background(), Options{}, exts).printFile(ff)
 }
 
 func (fb *fileBuilder) p(args ...interface{}) {
@@ -246,83 +537,50 @@ func (fb fileBuilder) indent() fileBuilder {
 
 func (fb *fileBuilder) printFile(ff protoreflect.FileDescriptor) ([]byte, error) {
 
-	if ff.Syntax() != protoreflect.Proto3 {
-		return nil, errors.New("only proto3 syntax is supported")
-	}
-
 	opening := ff.SourceLocations().ByPath(nil)
 	fb.leadingComments(opening)
-	fb.p("syntax = \"proto3\";")
+
+	switch ff.Syntax() {
+	case protoreflect.Proto3:
+		fb.p("syntax = \"proto3\";")
+	case protoreflect.Proto2:
+		fb.p("syntax = \"proto2\";")
+	case protoreflect.Editions:
+		edition := optionreflect.FileEdition(ff)
+		if edition == descriptorpb.Edition_EDITION_UNKNOWN {
+			return nil, fmt.Errorf("unknown edition")
+		}
+		fb.p("edition = \"", strings.TrimPrefix(edition.String(), "EDITION_"), "\";")
+	default:
+		return nil, fmt.Errorf("unsupported syntax %s", ff.Syntax())
+	}
 	fb.p()
 	fb.p("package ", ff.Package(), ";")
 	fb.addGap()
 
-	imports := ff.Imports()
-
-	importStrings := make([]string, 0, imports.Len())
-	for idx := 0; idx < imports.Len(); idx++ {
-		dep := imports.Get(idx)
-		importStrings = append(importStrings, dep.Path())
-	}
+	fb.printImports(ff)
 
-	if len(importStrings) > 0 {
-		sort.Strings(importStrings)
-		for _, dep := range importStrings {
-			fb.p("import \"", dep, "\";")
-		}
-		fb.addGap()
+	options, err := fb.optionsFor(ff)
+	if err != nil {
+		return nil, err
 	}
-	// This could be manual iteration, but seemed more future-proof and
-	// quicker to write.
-	refl := ff.Options().ProtoReflect()
-	fields := refl.Descriptor().Fields()
-	for i := 0; i < fields.Len(); i++ {
-		field := fields.Get(i)
-		if !refl.Has(field) {
-			continue
-		}
-		switch field.Kind() {
-		case protoreflect.BoolKind:
-			fb.p("option ", field.Name(), " = ", refl.Get(field).Interface(), ";")
-		case protoreflect.StringKind:
-			fb.p("option ", field.Name(), " = \"", refl.Get(field).Interface(), "\";")
-		}
+	for _, opt := range options {
+		fb.printOption(opt)
 	}
 	fb.addGap()
 
-	extBlocks := make([]extBlock, 0)
-
-	exts := ff.Extensions()
-	for idx := 0; idx < exts.Len(); idx++ {
-		ext := exts.Get(idx)
-		fullName := ext.ContainingMessage().FullName()
-		found := false
-		for i := range extBlocks {
-			if extBlocks[i].extends == fullName {
-				extBlocks[i].fields = append(extBlocks[i].fields, ext)
-				found = true
-				break
-			}
-		}
-		if !found {
-			extBlocks = append(extBlocks, extBlock{
-				extends: fullName,
-				fields:  []protoreflect.FieldDescriptor{ext},
-			})
-		}
-	}
-
-	for _, block := range extBlocks {
-		if err := fb.printExtension(block); err != nil {
-			return nil, err
-		}
-	}
-
 	var elements = make(sourceElements, 0)
 
+	groups := groupMessages(ff.Extensions())
+
 	messages := ff.Messages()
 	for idx := 0; idx < messages.Len(); idx++ {
-		elements.add(messages.Get(idx))
+		msg := messages.Get(idx)
+		if _, ok := groups[msg.FullName()]; ok {
+			// printed in place of the group field
+			continue
+		}
+		elements.add(msg)
 	}
 
 	services := ff.Services()
@@ -335,6 +593,11 @@ func (fb *fileBuilder) printFile(ff protoreflect.FileDescriptor) ([]byte, error)
 		elements.add(enums.Get(idx))
 	}
 
+	// field 7 of FileDescriptorProto is extension
+	for _, block := range fb.extendBlocks(ff, ff.Extensions(), 7) {
+		elements.addExtension(block)
+	}
+
 	if err := fb.printElements(elements); err != nil {
 		return nil, err
 	}
@@ -342,7 +605,7 @@ func (fb *fileBuilder) printFile(ff protoreflect.FileDescriptor) ([]byte, error)
 	return fb.out.out.Bytes(), nil
 }
 
-func fieldTypeName(field protoreflect.FieldDescriptor) (string, error) {
+func (fb *fileBuilder) fieldTypeName(field protoreflect.FieldDescriptor) (string, error) {
 	fieldType := field.Kind()
 
 	var refElement protoreflect.Descriptor
@@ -350,7 +613,9 @@ func fieldTypeName(field protoreflect.FieldDescriptor) (string, error) {
 	switch fieldType {
 	case protoreflect.EnumKind:
 		refElement = field.Enum()
-	case protoreflect.MessageKind:
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		// Editions fields with delimited encoding are groups, but are
+		// declared as messages.
 		refElement = field.Message()
 	default:
 		return fieldType.String(), nil
@@ -359,46 +624,6 @@ func fieldTypeName(field protoreflect.FieldDescriptor) (string, error) {
 	if refElement == nil {
 		return "", fmt.Errorf("field type is nil for %s", field.FullName())
 	}
-	fieldMsg := field.Parent()
-
-	return contextRefName(fieldMsg, refElement)
-}
-
-func contextRefName(contextOfCall protoreflect.Descriptor, refElement protoreflect.Descriptor) (string, error) {
-
-	if contextOfCall.ParentFile().Package() != refElement.ParentFile().Package() {
-		// if the thing the field references is in a different package, then the
-		// full reference is used
-		return string(refElement.FullName()), nil
-	}
-
-	refPath := pathToPackage(refElement)
-	contextPath := pathToPackage(contextOfCall)
-
-	for i := 0; i < len(contextPath); i++ {
-		if len(refPath) == 0 || refPath[0] != contextPath[i] {
-			break
-		}
-		refPath = refPath[1:]
-	}
-
-	return strings.Join(refPath, "."), nil
-}
-
-func pathToPackage(refElement protoreflect.Descriptor) []string {
-
-	refPath := make([]string, 0)
-	parentFileName := refElement.ParentFile().FullName()
-	parent := refElement
-	for parent.FullName() != parentFileName {
-		refPath = append(refPath, string(parent.Name()))
-		parent = parent.Parent()
-	}
-
-	stringsOut := make([]string, len(refPath))
-	for i, part := range refPath {
-		stringsOut[len(refPath)-i-1] = part
-	}
 
-	return stringsOut
+	return fb.refName(field.Parent(), refElement, true), nil
 }
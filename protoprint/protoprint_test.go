@@ -1,18 +1,31 @@
 package protoprint
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
+	"github.com/bufbuild/protocompile"
+	"github.com/pentops/prototools/optionreflect"
 	"github.com/pentops/prototools/protosrc"
+	"github.com/stretchr/testify/assert"
 	"google.golang.org/genproto/googleapis/api/annotations"
 	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
 	"google.golang.org/protobuf/reflect/protoregistry"
 	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
 )
 
 func TestSimplePrint(t *testing.T) {
@@ -209,6 +222,112 @@ func assertEqualLines(t *testing.T, wantLines, gotLines []string) {
 	}
 }
 
+// compileFiles compiles the given in-memory proto sources, falling back to the
+// global registry for imports.
+func compileFiles(t testing.TB, files map[string]string, names ...string) []protoreflect.FileDescriptor {
+	t.Helper()
+
+	resolver := protocompile.ResolverFunc(func(filename string) (protocompile.SearchResult, error) {
+		if content, ok := files[filename]; ok {
+			return protocompile.SearchResult{
+				Source: strings.NewReader(content),
+			}, nil
+		}
+		desc, err := protoregistry.GlobalFiles.FindFileByPath(filename)
+		if err != nil {
+			return protocompile.SearchResult{}, err
+		}
+		return protocompile.SearchResult{
+			Desc: desc,
+		}, nil
+	})
+
+	compiler := protocompile.Compiler{
+		Resolver:       protocompile.WithStandardImports(resolver),
+		SourceInfoMode: protocompile.SourceInfoExtraComments | protocompile.SourceInfoExtraOptionLocations,
+	}
+
+	compiled, err := compiler.Compile(context.Background(), names...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descriptors := make([]protoreflect.FileDescriptor, len(compiled))
+	for i, d := range compiled {
+		descriptors[i] = d
+	}
+	return descriptors
+}
+
+// assertRoundTrip compiles the source, prints it, and asserts the output
+// matches the input exactly. The compiled output is returned for further
+// assertions.
+func assertRoundTrip(t *testing.T, src string) protoreflect.FileDescriptor {
+	t.Helper()
+
+	input := compileFiles(t, map[string]string{"test.proto": src}, "test.proto")[0]
+
+	output, err := printFile(input, optionreflect.NewBuilder(optionreflect.FileExtensions(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(output, []byte(src)) {
+		assertEqualLines(t, strings.Split(src, "\n"), strings.Split(string(output), "\n"))
+		t.FailNow()
+	}
+
+	if err := Verify(context.Background(), input, output); err != nil {
+		t.Fatal(err)
+	}
+
+	return compileFiles(t, map[string]string{"test.proto": string(output)}, "test.proto")[0]
+}
+
+func TestStreamingMethods(t *testing.T) {
+	printed := assertRoundTrip(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`service StreamService {`,
+		`  rpc Unary(Msg) returns (Msg) {}`,
+		``,
+		`  rpc ClientStream(stream Msg) returns (Msg) {}`,
+		``,
+		`  rpc ServerStream(Msg) returns (stream Msg) {}`,
+		``,
+		`  rpc BidiStream(stream Msg) returns (stream Msg) {}`,
+		`}`,
+		``,
+		`message Msg {}`,
+		``,
+	}, "\n"))
+
+	methods := printed.Services().ByName("StreamService").Methods()
+	for _, tc := range []struct {
+		name   protoreflect.Name
+		client bool
+		server bool
+	}{
+		{name: "Unary"},
+		{name: "ClientStream", client: true},
+		{name: "ServerStream", server: true},
+		{name: "BidiStream", client: true, server: true},
+	} {
+		method := methods.ByName(tc.name)
+		if method == nil {
+			t.Fatalf("method %s not found", tc.name)
+		}
+		if method.IsStreamingClient() != tc.client {
+			t.Errorf("%s: want client streaming %v", tc.name, tc.client)
+		}
+		if method.IsStreamingServer() != tc.server {
+			t.Errorf("%s: want server streaming %v", tc.name, tc.server)
+		}
+	}
+}
+
 type fileMap map[string][]byte
 
 func NewFileMap() fileMap {
@@ -260,3 +379,2156 @@ func TestExampleReal(t *testing.T) {
 	assertEqualLines(t, realLines, gotLines)
 
 }
+
+func TestReserved(t *testing.T) {
+	assertRoundTrip(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`message Foo {`,
+		`  string a = 1;`,
+		``,
+		`  // Comment on reserved`,
+		`  reserved 4, 8 to 10;`,
+		`  reserved 20 to max;`,
+		`  reserved "old_field", "other";`,
+		`  string b = 2;`,
+		`}`,
+		``,
+		`enum Enum {`,
+		`  ENUM_UNSPECIFIED = 0;`,
+		`  reserved 3, 5 to max; // Inline`,
+		`  reserved "ENUM_OLD";`,
+		`}`,
+		``,
+	}, "\n"))
+}
+
+func TestReservedCollapse(t *testing.T) {
+	input := compileFiles(t, map[string]string{"test.proto": strings.Join([]string{
+		`syntax = "proto3";`,
+		`package test.v1;`,
+		`message Foo {`,
+		`  reserved 1, 2, 3, 5, 6 to 8, 9 to max;`,
+		`}`,
+		`enum Enum {`,
+		`  ENUM_UNSPECIFIED = 0;`,
+		`  reserved 1, 2, 4;`,
+		`}`,
+	}, "\n")}, "test.proto")[0]
+
+	output, err := printFile(input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqualLines(t, []string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`message Foo {`,
+		`  reserved 1 to 3, 5 to max;`,
+		`}`,
+		``,
+		`enum Enum {`,
+		`  ENUM_UNSPECIFIED = 0;`,
+		`  reserved 1 to 2, 4;`,
+		`}`,
+		``,
+	}, strings.Split(string(output), "\n"))
+}
+
+func TestProto2(t *testing.T) {
+	printed := assertRoundTrip(t, strings.Join([]string{
+		`syntax = "proto2";`,
+		``,
+		`package test.v1;`,
+		``,
+		`message Foo {`,
+		`  required string id = 1;`,
+		`  optional int32 count = 2 [default = 10];`,
+		`  repeated string tags = 3;`,
+		`  optional string name = 4 [default = "unnamed\n"];`,
+		`  optional Enum enum = 5 [default = ENUM_B];`,
+		`  optional double ratio = 6 [default = -inf];`,
+		``,
+		`  // Group comment`,
+		`  optional group Result = 7 {`,
+		`    required string url = 8;`,
+		`    optional bool ok = 9 [default = true];`,
+		`  }`,
+		``,
+		`  oneof choice {`,
+		`    string a = 10;`,
+		`    int64 b = 11;`,
+		`  }`,
+		``,
+		`  map<string, string> labels = 12;`,
+		``,
+		`  extensions 100 to 199, 300;`,
+		`  extensions 1000 to max;`,
+		``,
+		`  // Extend comment`,
+		`  extend Foo {`,
+		`    optional int32 nested_ext = 100;`,
+		`    repeated group NestedGroup = 101 {`,
+		`      optional string value = 1;`,
+		`    }`,
+		`  }`,
+		`}`,
+		``,
+		`enum Enum {`,
+		`  ENUM_A = 1;`,
+		`  ENUM_B = 2;`,
+		`}`,
+		``,
+	}, "\n"))
+
+	if printed.Syntax() != protoreflect.Proto2 {
+		t.Fatalf("expected proto2, got %s", printed.Syntax())
+	}
+	foo := printed.Messages().ByName("Foo")
+	if foo.Fields().ByName("id").Cardinality() != protoreflect.Required {
+		t.Error("id should be required")
+	}
+	if foo.Fields().ByName("count").Default().Int() != 10 {
+		t.Error("count should default to 10")
+	}
+	if foo.Fields().ByName("result").Kind() != protoreflect.GroupKind {
+		t.Error("result should be a group")
+	}
+	if foo.ExtensionRanges().Len() != 3 {
+		t.Errorf("expected 3 extension ranges, got %d", foo.ExtensionRanges().Len())
+	}
+	if foo.Extensions().Len() != 2 {
+		t.Errorf("expected 2 nested extensions, got %d", foo.Extensions().Len())
+	}
+}
+
+func TestExtensionRangeOptions(t *testing.T) {
+	src := strings.Join([]string{
+		`syntax = "proto2";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`message Foo {`,
+		`  extensions 100 to 199 [verification = UNVERIFIED];`,
+		``,
+		`  // Declared`,
+		`  extensions 200 to 299 [`,
+		`    declaration = {`,
+		`      number: 200`,
+		`      full_name: ".test.v1.bar"`,
+		`      type: "string"`,
+		`    },`,
+		`    (range_label) = "declared"`,
+		`  ];`,
+		``,
+		`  extensions 1000 to max;`,
+		`}`,
+		``,
+		`extend google.protobuf.ExtensionRangeOptions {`,
+		`  optional string range_label = 50000;`,
+		`}`,
+		``,
+	}, "\n")
+
+	printed := assertRoundTrip(t, src)
+	foo := printed.Messages().ByName("Foo")
+	opts := foo.ExtensionRangeOptions(0).(*descriptorpb.ExtensionRangeOptions)
+	if opts.GetVerification() != descriptorpb.ExtensionRangeOptions_UNVERIFIED {
+		t.Errorf("expected the first range to be unverified, got %s", opts.GetVerification())
+	}
+
+	t.Run("without source", func(t *testing.T) {
+		// Without source info the ranges are not grouped by statement, ranges
+		// with different options are split.
+		input := compileFiles(t, map[string]string{"test.proto": strings.Replace(src,
+			`extensions 1000 to max;`,
+			"extensions 1000 to 1999;\n  extensions 3000 to max [verification = UNVERIFIED];", 1),
+		}, "test.proto")[0]
+		fdp := protodesc.ToFileDescriptorProto(input)
+		fdp.SourceCodeInfo = nil
+		stripped, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := printFile(stripped, optionreflect.NewBuilder(optionreflect.FileExtensions(stripped)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqualLines(t, []string{
+			`syntax = "proto2";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "google/protobuf/descriptor.proto";`,
+			``,
+			`extend google.protobuf.ExtensionRangeOptions {`,
+			`  optional string range_label = 50000;`,
+			`}`,
+			``,
+			`message Foo {`,
+			`  extensions 100 to 199 [verification = UNVERIFIED];`,
+			`  extensions 200 to 299 [`,
+			`    declaration = {`,
+			`      number: 200`,
+			`      full_name: ".test.v1.bar"`,
+			`      type: "string"`,
+			`    },`,
+			`    (range_label) = "declared"`,
+			`  ];`,
+			`  extensions 1000 to 1999;`,
+			`  extensions 3000 to max [verification = UNVERIFIED];`,
+			`}`,
+			``,
+		}, strings.Split(string(output), "\n"))
+	})
+}
+
+func TestEditions(t *testing.T) {
+	printed := assertRoundTrip(t, strings.Join([]string{
+		`edition = "2023";`,
+		``,
+		`package test.v1;`,
+		``,
+		`option features.field_presence = IMPLICIT;`,
+		`option features.enum_type = CLOSED;`,
+		``,
+		`message Foo {`,
+		`  option features.json_format = LEGACY_BEST_EFFORT;`,
+		``,
+		`  string id = 1 [features.field_presence = LEGACY_REQUIRED];`,
+		`  string name = 2 [features.field_presence = EXPLICIT];`,
+		`  Foo child = 3 [features.message_encoding = DELIMITED];`,
+		`  repeated int32 numbers = 4 [features.repeated_field_encoding = EXPANDED];`,
+		``,
+		`  reserved 10;`,
+		`  reserved old_name;`,
+		`}`,
+		``,
+		`enum Enum {`,
+		`  option features.enum_type = OPEN;`,
+		``,
+		`  ENUM_UNSPECIFIED = 0;`,
+		`}`,
+		``,
+	}, "\n"))
+
+	foo := printed.Messages().ByName("Foo")
+	if foo.Fields().ByName("id").Cardinality() != protoreflect.Required {
+		t.Error("id should be required")
+	}
+	if !foo.Fields().ByName("name").HasPresence() {
+		t.Error("name should have presence")
+	}
+	if foo.Fields().ByName("numbers").IsPacked() {
+		t.Error("numbers should not be packed")
+	}
+	if foo.Fields().ByName("child").Kind() != protoreflect.GroupKind {
+		t.Error("child should be delimited")
+	}
+}
+
+func TestEditionsInheritedFeatures(t *testing.T) {
+	input := compileFiles(t, map[string]string{"test.proto": strings.Join([]string{
+		`edition = "2023";`,
+		`package test.v1;`,
+		`option features.field_presence = IMPLICIT;`,
+		`option features.json_format = ALLOW;`,
+		`message Foo {`,
+		`  option features.json_format = LEGACY_BEST_EFFORT;`,
+		`  string id = 1 [features.field_presence = IMPLICIT];`,
+		`  string name = 2 [features.field_presence = EXPLICIT];`,
+		`}`,
+	}, "\n")}, "test.proto")[0]
+
+	output, err := printFile(input, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqualLines(t, []string{
+		`edition = "2023";`,
+		``,
+		`package test.v1;`,
+		``,
+		`option features.field_presence = IMPLICIT;`,
+		``,
+		`message Foo {`,
+		`  option features.json_format = LEGACY_BEST_EFFORT;`,
+		``,
+		`  string id = 1;`,
+		`  string name = 2 [features.field_presence = EXPLICIT];`,
+		`}`,
+		``,
+	}, strings.Split(string(output), "\n"))
+}
+
+func TestFileOptions(t *testing.T) {
+	assertRoundTrip(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`// Comment on go_package`,
+		`option go_package = "github.com/example/test/v1";`,
+		`option optimize_for = SPEED;`,
+		`option (file_string) = "custom"; // Inline comment`,
+		`option java_multiple_files = true;`,
+		`option (file_int) = 42;`,
+		``,
+		`extend google.protobuf.FileOptions {`,
+		`  string file_string = 50000;`,
+		`  int32 file_int = 50001;`,
+		`}`,
+		``,
+	}, "\n"))
+}
+
+func TestBuiltInOptions(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  []string
+	}{{
+		name: "file",
+		src: []string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`option java_package = "com.example.test";`,
+			`option java_outer_classname = "TestProto";`,
+			`option java_multiple_files = true;`,
+			`option java_generate_equals_and_hash = true;`,
+			`option java_string_check_utf8 = true;`,
+			`option optimize_for = CODE_SIZE;`,
+			`option go_package = "github.com/example/test/v1";`,
+			`option cc_generic_services = false;`,
+			`option java_generic_services = false;`,
+			`option py_generic_services = false;`,
+			`option deprecated = true;`,
+			`option cc_enable_arenas = true;`,
+			`option objc_class_prefix = "TST";`,
+			`option csharp_namespace = "Example.Test";`,
+			`option swift_prefix = "TST";`,
+			`option php_class_prefix = "TST";`,
+			`option php_namespace = "Example\\Test";`,
+			`option php_metadata_namespace = "Example\\Test\\Meta";`,
+			`option ruby_package = "Example::Test";`,
+			``,
+		},
+	}, {
+		name: "message",
+		src: []string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`message Foo {`,
+			`  option no_standard_descriptor_accessor = true;`,
+			``,
+			`  option deprecated = true;`,
+			``,
+			`  option deprecated_legacy_json_field_conflicts = true;`,
+			`}`,
+			``,
+		},
+	}, {
+		name: "message set",
+		src: []string{
+			`syntax = "proto2";`,
+			``,
+			`package test.v1;`,
+			``,
+			`message Foo {`,
+			`  option message_set_wire_format = true;`,
+			``,
+			`  extensions 4 to max;`,
+			`}`,
+			``,
+		},
+	}, {
+		name: "extension range",
+		src: []string{
+			`syntax = "proto2";`,
+			``,
+			`package test.v1;`,
+			``,
+			`message Foo {`,
+			`  extensions 100 to 199 [verification = UNVERIFIED];`,
+			`  extensions 200 to 299 [`,
+			`    declaration = {`,
+			`      number: 200`,
+			`      full_name: ".test.v1.bar"`,
+			`      type: ".test.v1.Foo"`,
+			`    },`,
+			`    declaration = {`,
+			`      number: 201`,
+			`      full_name: ".test.v1.baz"`,
+			`      type: "string"`,
+			`      repeated: true`,
+			`    },`,
+			`    declaration = {`,
+			`      number: 202`,
+			`      reserved: true`,
+			`    },`,
+			`    verification = DECLARATION`,
+			`  ];`,
+			`}`,
+			``,
+			`extend Foo {`,
+			`  optional Foo bar = 200;`,
+			`  repeated string baz = 201;`,
+			`}`,
+			``,
+		},
+	}, {
+		name: "field",
+		src: []string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`message Foo {`,
+			`  string a = 1 [deprecated = true];`,
+			`  string b = 2 [json_name = "bee"];`,
+			`  repeated int32 c = 3 [packed = false];`,
+			`  int64 d = 4 [jstype = JS_STRING];`,
+			`  string e = 5 [ctype = CORD];`,
+			`  Foo f = 6 [lazy = true];`,
+			`  Foo g = 7 [unverified_lazy = true];`,
+			`  string h = 8 [debug_redact = true];`,
+			`  string i = 9 [retention = RETENTION_SOURCE];`,
+			`  string j = 10 [`,
+			`    targets = TARGET_TYPE_FIELD,`,
+			`    targets = TARGET_TYPE_MESSAGE`,
+			`  ];`,
+			`  string k = 11 [`,
+			`    json_name = "kay",`,
+			`    deprecated = true`,
+			`  ];`,
+			`}`,
+			``,
+		},
+	}, {
+		name: "proto2 field",
+		src: []string{
+			`syntax = "proto2";`,
+			``,
+			`package test.v1;`,
+			``,
+			`message Foo {`,
+			`  optional string a = 1 [default = "a"];`,
+			`  repeated int32 b = 2 [packed = true];`,
+			`  optional string c = 3 [`,
+			`    default = "c",`,
+			`    deprecated = true`,
+			`  ];`,
+			`}`,
+			``,
+		},
+	}, {
+		name: "enum",
+		src: []string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`enum Foo {`,
+			`  option allow_alias = true;`,
+			``,
+			`  option deprecated = true;`,
+			``,
+			`  option deprecated_legacy_json_field_conflicts = true;`,
+			``,
+			`  FOO_UNSPECIFIED = 0;`,
+			`  FOO_ALIAS = 0 [deprecated = true];`,
+			`  FOO_SECRET = 1 [debug_redact = true];`,
+			`}`,
+			``,
+		},
+	}, {
+		name: "service",
+		src: []string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`service FooService {`,
+			`  option deprecated = true;`,
+			``,
+			`  rpc Get(Foo) returns (Foo) {`,
+			`    option deprecated = true;`,
+			`    option idempotency_level = NO_SIDE_EFFECTS;`,
+			`  }`,
+			`}`,
+			``,
+			`message Foo {}`,
+			``,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			assertRoundTrip(t, strings.Join(tc.src, "\n"))
+		})
+	}
+}
+
+func TestImports(t *testing.T) {
+	files := map[string]string{
+		"test/v1/local.proto":  `syntax = "proto3"; package test.v1; message Local {}`,
+		"test/v1/public.proto": `syntax = "proto3"; package test.v1; message Public {}`,
+		"test/v1/weak.proto":   `syntax = "proto3"; package test.v1; message Weak {}`,
+		"ext/v1/ext.proto":     `syntax = "proto3"; package ext.v1; message Ext {}`,
+		"test/v1/test.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import "test/v1/local.proto";`,
+			`// Comment on public import`,
+			`import public "test/v1/public.proto";`,
+			`import weak "test/v1/weak.proto"; // Inline weak`,
+			`import "google/protobuf/empty.proto";`,
+			`import "ext/v1/ext.proto";`,
+		}, "\n"),
+	}
+	compiled := compileFiles(t, files, "test/v1/test.proto")
+	input := compiled[0]
+
+	for _, tc := range []struct {
+		name     string
+		options  Options
+		expected []string
+	}{{
+		name: "single block",
+		expected: []string{
+			`import "ext/v1/ext.proto";`,
+			`import "google/protobuf/empty.proto";`,
+			`import "test/v1/local.proto";`,
+			``,
+			`// Comment on public import`,
+			`import public "test/v1/public.proto";`,
+			`import weak "test/v1/weak.proto"; // Inline weak`,
+		},
+	}, {
+		name: "grouped",
+		options: Options{
+			GroupImports: true,
+		},
+		expected: []string{
+			`import "google/protobuf/empty.proto";`,
+			``,
+			`import "ext/v1/ext.proto";`,
+			``,
+			`import "test/v1/local.proto";`,
+			``,
+			`// Comment on public import`,
+			`import public "test/v1/public.proto";`,
+			`import weak "test/v1/weak.proto"; // Inline weak`,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			printer := &filePrinter{
+				options: tc.options,
+				localFiles: map[string]struct{}{
+					"test/v1/test.proto":   {},
+					"test/v1/local.proto":  {},
+					"test/v1/public.proto": {},
+					"test/v1/weak.proto":   {},
+				},
+			}
+			output, err := printer.printFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := append([]string{
+				`syntax = "proto3";`,
+				``,
+				`package test.v1;`,
+				``,
+			}, tc.expected...)
+			expected = append(expected, "")
+			assertEqualLines(t, expected, strings.Split(string(output), "\n"))
+
+			files["test/v1/test.proto"] = string(output)
+			reparsed := compileFiles(t, files, "test/v1/test.proto")[0]
+			imports := reparsed.Imports()
+			for idx := 0; idx < imports.Len(); idx++ {
+				imp := imports.Get(idx)
+				if imp.IsPublic != (imp.Path() == "test/v1/public.proto") {
+					t.Errorf("unexpected public flag on %s", imp.Path())
+				}
+				if imp.IsWeak != (imp.Path() == "test/v1/weak.proto") {
+					t.Errorf("unexpected weak flag on %s", imp.Path())
+				}
+			}
+		})
+	}
+
+	t.Run("filters keep the local files", func(t *testing.T) {
+		all := compileFiles(t, files, "test/v1/test.proto", "test/v1/local.proto", "ext/v1/ext.proto")
+
+		printTest := func(opts Options) []string {
+			outputMap := NewFileMap()
+			if err := PrintReflect(context.Background(), outputMap, all, opts); err != nil {
+				t.Fatal(err)
+			}
+			output, err := outputMap.GetFile("test/v1/test.proto")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return strings.Split(string(output), "\n")
+		}
+
+		// local.proto is passed in but not printed, it is still local.
+		unfiltered := printTest(Options{GroupImports: true})
+		filtered := printTest(Options{
+			GroupImports:  true,
+			OnlyFilenames: []string{"test/v1/test.proto"},
+		})
+		assertEqualLines(t, unfiltered, filtered)
+		assert.Contains(t, unfiltered, `import "test/v1/local.proto";`)
+	})
+}
+
+func TestNestedExtensions(t *testing.T) {
+	assertRoundTrip(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`message Foo {`,
+		`  string id = 1 [(Scope.field_opt) = "foo"];`,
+		`  string name = 2 [(top_opt) = 1];`,
+		`}`,
+		``,
+		`// Top level extend`,
+		`extend google.protobuf.FieldOptions {`,
+		`  int32 top_opt = 50001;`,
+		`}`,
+		``,
+		`message Scope {`,
+		`  string id = 1 [(field_opt) = "scope"];`,
+		``,
+		`  // Nested extend`,
+		`  extend google.protobuf.FieldOptions {`,
+		`    string field_opt = 50000;`,
+		`  }`,
+		``,
+		`  string name = 2;`,
+		``,
+		`  message Inner {`,
+		`    string id = 1 [(field_opt) = "inner"];`,
+		`  }`,
+		`}`,
+		``,
+	}, "\n"))
+}
+
+func TestPrintProtoFilesNestedExtensions(t *testing.T) {
+	files := map[string]string{
+		"test/v1/ext.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import "google/protobuf/descriptor.proto";`,
+			`message Scope {`,
+			`  extend google.protobuf.MessageOptions {`,
+			`    Scope message_opt = 50000;`,
+			`  }`,
+			`  string value = 1;`,
+			`}`,
+		}, "\n"),
+		"test/v1/test.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "test/v1/ext.proto";`,
+			``,
+			`message Foo {`,
+			`  option (Scope.message_opt).value = "foo";`,
+			`}`,
+			``,
+		}, "\n"),
+	}
+	compiled := compileFiles(t, files, "test/v1/ext.proto", "test/v1/test.proto")
+
+	fds := &descriptorpb.FileDescriptorSet{}
+	for _, file := range compiled {
+		fds.File = append(fds.File, protodesc.ToFileDescriptorProto(file))
+	}
+
+	outputMap := NewFileMap()
+	if err := PrintProtoFiles(context.Background(), outputMap, fds, Options{
+		OnlyFilenames: []string{"test/v1/test.proto"},
+		Verify:        true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := outputMap.GetFile("test/v1/test.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualLines(t, strings.Split(files["test/v1/test.proto"], "\n"), strings.Split(string(output), "\n"))
+}
+
+func TestReferenceScopes(t *testing.T) {
+	files := map[string]string{
+		"b/b.proto": `syntax = "proto3"; package b; message C {}`,
+		"a/b/test.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			``,
+			`package a.b;`,
+			``,
+			`import "b/b.proto";`,
+			`import "google/protobuf/descriptor.proto";`,
+			``,
+			`message Bar {}`,
+			``,
+			`message Foo {`,
+			``,
+			`  // The nested Bar shadows the top level Bar`,
+			`  b.Bar top = 1;`,
+			`  Bar nested = 2;`,
+			``,
+			`  // b.C would resolve to a.b.C, which does not exist`,
+			`  .b.C other = 3;`,
+			``,
+			`  message Bar {}`,
+			`}`,
+			``,
+			`message Scope {`,
+			``,
+			`  // Message options are resolved in the scope of the message's parent`,
+			`  option (Scope.message_opt) = "scope";`,
+			``,
+			`  extend google.protobuf.MessageOptions {`,
+			`    string message_opt = 50000;`,
+			`  }`,
+			``,
+			`  string id = 1 [(field_opt) = "scope"];`,
+			``,
+			`  extend google.protobuf.FieldOptions {`,
+			`    string field_opt = 50001;`,
+			`  }`,
+			`}`,
+			``,
+		}, "\n"),
+	}
+	compiled := compileFiles(t, files, "b/b.proto", "a/b/test.proto")
+
+	outputMap := NewFileMap()
+	if err := PrintReflect(context.Background(), outputMap, compiled, Options{
+		OnlyFilenames: []string{"a/b/test.proto"},
+		Verify:        true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := outputMap.GetFile("a/b/test.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqualLines(t, strings.Split(files["a/b/test.proto"], "\n"), strings.Split(string(output), "\n"))
+}
+
+func TestMapOptions(t *testing.T) {
+	assertRoundTrip(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`message Foo {`,
+		`  option (map_opt) = {`,
+		`    entries: [{`,
+		`      key: "a"`,
+		`      value: {`,
+		`        name: "first"`,
+		`      }`,
+		`    }, {`,
+		`      key: "b"`,
+		`      value: {`,
+		`        name: "second"`,
+		`      }`,
+		`    }]`,
+		`  };`,
+		`}`,
+		``,
+		`message MapOpt {`,
+		`  map<string, Inner> entries = 1;`,
+		``,
+		`  message Inner {`,
+		`    string name = 1;`,
+		`  }`,
+		`}`,
+		``,
+		`extend google.protobuf.MessageOptions {`,
+		`  MapOpt map_opt = 50000;`,
+		`}`,
+		``,
+	}, "\n"))
+}
+
+func TestOptionValueComments(t *testing.T) {
+	assertRoundTrip(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`message Foo {`,
+		`  option (rule) = {`,
+		`    // Leading name`,
+		`    name: "foo" // Trailing name`,
+		``,
+		`    // Detached`,
+		``,
+		`    // Leading inner`,
+		`    inner: {`,
+		`      // Leading count`,
+		`      count: 1`,
+		`    } // Trailing inner`,
+		`    tags: [`,
+		`      // Leading first`,
+		`      "a",`,
+		`      "b" // Trailing last`,
+		`    ]`,
+		`    rules: [{`,
+		`      // Leading item`,
+		`      name: "x"`,
+		`    }]`,
+		`  };`,
+		``,
+		`  option (single) = {`,
+		`    // Keeps the braces`,
+		`    count: 2`,
+		`  };`,
+		``,
+		`  string id = 1 [`,
+		`    // Leading json`,
+		`    json_name = "ident",`,
+		`    // Leading opt`,
+		`    (field_rule) = {`,
+		`      name: "bar" // Trailing field name`,
+		`    } // Trailing opt`,
+		`  ];`,
+		`}`,
+		``,
+		`message Bar {`,
+		`  option (single).count = 3; // Trailing statement`,
+		`}`,
+		``,
+		`message Rule {`,
+		`  string name = 1;`,
+		`  Inner inner = 2;`,
+		`  repeated string tags = 3;`,
+		`  repeated Rule rules = 4;`,
+		``,
+		`  message Inner {`,
+		`    int32 count = 1;`,
+		`  }`,
+		`}`,
+		``,
+		`extend google.protobuf.MessageOptions {`,
+		`  Rule rule = 50000;`,
+		`  Rule.Inner single = 50001;`,
+		`}`,
+		``,
+		`extend google.protobuf.FieldOptions {`,
+		`  Rule field_rule = 50000;`,
+		`}`,
+		``,
+	}, "\n"))
+}
+
+func TestFieldOptionsTrailingComment(t *testing.T) {
+	// The comment is printed once, after the closing bracket. Compilers drop
+	// a comment after the opening bracket.
+	printed := assertRoundTrip(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`message Foo {`,
+		`  string a = 1 [`,
+		`    json_name = "aa",`,
+		`    deprecated = true`,
+		`  ]; // Trailing`,
+		`}`,
+		``,
+	}, "\n"))
+
+	field := printed.Messages().ByName("Foo").Fields().ByName("a")
+	loc := printed.SourceLocations().ByDescriptor(field)
+	assert.Equal(t, " Trailing\n", loc.TrailingComments)
+}
+
+func TestEmptyBlockComments(t *testing.T) {
+	// The trailing comment of a block or rpc follows the opening brace, so
+	// bodies with one are kept open rather than collapsed to {}.
+	assertRoundTrip(t, strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`message Empty {}`,
+		``,
+		`message Commented { // Trailing message`,
+		`}`,
+		``,
+		`enum Kind { // Trailing enum`,
+		`  KIND_UNSPECIFIED = 0;`,
+		`}`,
+		``,
+		`service Svc {`,
+		`  rpc Plain(Empty) returns (Empty) {}`,
+		``,
+		`  rpc Commented(Empty) returns (Empty) { // Trailing rpc`,
+		`  }`,
+		`}`,
+		``,
+	}, "\n"))
+}
+
+func TestOptionValueSeparatorComments(t *testing.T) {
+	// A comment between a value and its comma is printed after the comma.
+	// The compiler doesn't attach comments after a comma to anything, so they
+	// are kept this once but not when the printed file is printed again.
+	input := compileFiles(t, map[string]string{"test.proto": strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`message Foo {`,
+		`  option (tags) = {`,
+		`    tags: [`,
+		`      "a" /* Trailing first */,`,
+		`      "b"`,
+		`    ]`,
+		`  };`,
+		``,
+		`  string id = 1 [`,
+		`    json_name = "ident" /* Trailing json */,`,
+		`    deprecated = true`,
+		`  ];`,
+		`}`,
+		``,
+		`message Tags {`,
+		`  repeated string tags = 1;`,
+		`}`,
+		``,
+		`extend google.protobuf.MessageOptions {`,
+		`  Tags tags = 50000;`,
+		`}`,
+		``,
+	}, "\n")}, "test.proto")[0]
+
+	output, err := printFile(input, optionreflect.NewBuilder(optionreflect.FileExtensions(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqualLines(t, []string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`message Foo {`,
+		`  option (tags) = {`,
+		`    tags: [`,
+		`      "a", // Trailing first`,
+		`      "b"`,
+		`    ]`,
+		`  };`,
+		``,
+		`  string id = 1 [`,
+		`    json_name = "ident", // Trailing json`,
+		`    deprecated = true`,
+		`  ];`,
+		`}`,
+		``,
+		`message Tags {`,
+		`  repeated string tags = 1;`,
+		`}`,
+		``,
+		`extend google.protobuf.MessageOptions {`,
+		`  Tags tags = 50000;`,
+		`}`,
+		``,
+	}, strings.Split(string(output), "\n"))
+}
+
+func TestMapOptionComments(t *testing.T) {
+	// Map entries are printed sorted by key, which need not be the order of
+	// the source, so comments on and inside map fields are not kept.
+	input := compileFiles(t, map[string]string{"test.proto": strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`message Foo {`,
+		`  option (map_opt) = {`,
+		`    // Leading entries`,
+		`    entries: [{`,
+		`      key: "b" // Trailing key`,
+		`      value: 2`,
+		`    }, {`,
+		`      // Leading key`,
+		`      key: "a"`,
+		`      value: 1`,
+		`    }]`,
+		`  };`,
+		`}`,
+		``,
+		`message MapOpt {`,
+		`  map<string, int32> entries = 1;`,
+		`}`,
+		``,
+		`extend google.protobuf.MessageOptions {`,
+		`  MapOpt map_opt = 50000;`,
+		`}`,
+		``,
+	}, "\n")}, "test.proto")[0]
+
+	output, err := printFile(input, optionreflect.NewBuilder(optionreflect.FileExtensions(input)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqualLines(t, []string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`message Foo {`,
+		`  option (map_opt) = {`,
+		`    entries: [{`,
+		`      key: "a"`,
+		`      value: 1`,
+		`    }, {`,
+		`      key: "b"`,
+		`      value: 2`,
+		`    }]`,
+		`  };`,
+		`}`,
+		``,
+		`message MapOpt {`,
+		`  map<string, int32> entries = 1;`,
+		`}`,
+		``,
+		`extend google.protobuf.MessageOptions {`,
+		`  MapOpt map_opt = 50000;`,
+		`}`,
+		``,
+	}, strings.Split(string(output), "\n"))
+}
+
+func TestUnresolvedOptions(t *testing.T) {
+	files := map[string]string{
+		"test/v1/ext.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import "google/protobuf/descriptor.proto";`,
+			`message Rule {`,
+			`  string name = 1;`,
+			`  int32 weight = 2;`,
+			`}`,
+			`extend google.protobuf.MessageOptions {`,
+			`  Rule rule = 50000;`,
+			`}`,
+			`extend google.protobuf.FieldOptions {`,
+			`  bool sensitive = 50001;`,
+			`}`,
+		}, "\n"),
+		"test/v1/test.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "test/v1/ext.proto";`,
+			``,
+			`message Foo {`,
+			`  option (rule).name = "foo";`,
+			``,
+			`  option (rule).weight = 2;`,
+			``,
+			`  string a = 1 [(sensitive) = true];`,
+			`}`,
+			``,
+			`message Bar {`,
+			`  option (rule) = {`,
+			`    name: "bar"`,
+			`    weight: 3`,
+			`  };`,
+			`}`,
+			``,
+		}, "\n"),
+	}
+	compiled := compileFiles(t, files, "test/v1/ext.proto", "test/v1/test.proto")
+
+	// The extensions are declared in a file which is not in the set, the
+	// round trip through the wire format drops the compiled extension types.
+	raw, err := proto.Marshal(&descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(compiled[1]),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds := &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(raw, fds); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		err := PrintProtoFiles(context.Background(), NewFileMap(), fds, Options{})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("strict error position", func(t *testing.T) {
+		fd, err := protodesc.FileOptions{AllowUnresolvable: true}.New(fds.File[0], &protoregistry.Files{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = PrintReflect(context.Background(), NewFileMap(), []protoreflect.FileDescriptor{fd}, Options{})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		printErr := &Error{}
+		if !errors.As(err, &printErr) {
+			t.Fatalf("expected an Error, got %v", err)
+		}
+		assert.Equal(t, "test/v1/test.proto", printErr.Filename)
+		assert.Equal(t, protoreflect.FullName("test.v1.Foo"), printErr.Element)
+		assert.Equal(t, 7, printErr.Line)
+		assert.Equal(t, 1, printErr.Column)
+	})
+
+	t.Run("from source", func(t *testing.T) {
+		warnings := []Warning{}
+		outputMap := NewFileMap()
+		if err := PrintProtoFiles(context.Background(), outputMap, fds, Options{
+			Lenient: true,
+			Source: fstest.MapFS{
+				"test/v1/test.proto": &fstest.MapFile{Data: []byte(files["test/v1/test.proto"])},
+			},
+			OnWarning: func(w Warning) {
+				warnings = append(warnings, w)
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := outputMap.GetFile("test/v1/test.proto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqualLines(t, strings.Split(files["test/v1/test.proto"], "\n"), strings.Split(string(output), "\n"))
+
+		if len(warnings) != 3 {
+			t.Fatalf("expected 3 warnings, got %v", warnings)
+		}
+		if warnings[0].Element != "test.v1.Foo" || warnings[0].Filename != "test/v1/test.proto" {
+			t.Errorf("unexpected warning %s", warnings[0])
+		}
+	})
+
+	t.Run("mismatched source", func(t *testing.T) {
+		// The first statement's span covers a different option in this
+		// source, so it is not printed from it.
+		changed := strings.Replace(files["test/v1/test.proto"], `option (rule).name = "foo";`, `option deprecated = true;`, 1)
+		warnings := []Warning{}
+		outputMap := NewFileMap()
+		if err := PrintProtoFiles(context.Background(), outputMap, fds, Options{
+			Lenient: true,
+			Source: fstest.MapFS{
+				"test/v1/test.proto": &fstest.MapFile{Data: []byte(changed)},
+			},
+			OnWarning: func(w Warning) {
+				warnings = append(warnings, w)
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := outputMap.GetFile("test/v1/test.proto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := strings.Replace(files["test/v1/test.proto"], "  option (rule).name = \"foo\";\n\n", "", 1)
+		assertEqualLines(t, strings.Split(want, "\n"), strings.Split(string(output), "\n"))
+
+		if len(warnings) != 4 {
+			t.Fatalf("expected 4 warnings, got %v", warnings)
+		}
+		assert.Contains(t, warnings[1].Message, "the source does not match the descriptor")
+	})
+
+	t.Run("without source", func(t *testing.T) {
+		warnings := []Warning{}
+		outputMap := NewFileMap()
+		if err := PrintProtoFiles(context.Background(), outputMap, fds, Options{
+			Lenient: true,
+			OnWarning: func(w Warning) {
+				warnings = append(warnings, w)
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := outputMap.GetFile("test/v1/test.proto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqualLines(t, []string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "test/v1/ext.proto";`,
+			``,
+			`message Foo {`,
+			`  string a = 1;`,
+			`}`,
+			``,
+			`message Bar {}`,
+			``,
+		}, strings.Split(string(output), "\n"))
+
+		if len(warnings) != 3 {
+			t.Fatalf("expected 3 warnings, got %v", warnings)
+		}
+	})
+}
+
+func TestImportedExtensions(t *testing.T) {
+	files := map[string]string{
+		"test/v1/ext.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import "google/protobuf/descriptor.proto";`,
+			`extend google.protobuf.MessageOptions {`,
+			`  bool sensitive = 50000;`,
+			`}`,
+		}, "\n"),
+		"test/v1/base.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import public "test/v1/ext.proto";`,
+		}, "\n"),
+		"test/v1/test.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "test/v1/base.proto";`,
+			``,
+			`message Foo {`,
+			`  option (sensitive) = true;`,
+			`}`,
+			``,
+		}, "\n"),
+	}
+	compiled := compileFiles(t, files, "test/v1/ext.proto", "test/v1/base.proto", "test/v1/test.proto")
+
+	// Built from the wire format, the options hold the extension as unknown
+	// fields, it is only declared in an indirect import.
+	fds := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{
+			protodesc.ToFileDescriptorProto(descriptorpb.File_google_protobuf_descriptor_proto),
+		},
+	}
+	for _, file := range compiled {
+		fds.File = append(fds.File, protodesc.ToFileDescriptorProto(file))
+	}
+	raw, err := proto.Marshal(fds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fds = &descriptorpb.FileDescriptorSet{}
+	if err := proto.Unmarshal(raw, fds); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("PrintFile", func(t *testing.T) {
+		registry, err := protodesc.NewFiles(fds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file, err := registry.FindFileByPath("test/v1/test.proto")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		output, err := PrintFile(context.Background(), file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqualLines(t, strings.Split(files["test/v1/test.proto"], "\n"), strings.Split(output, "\n"))
+	})
+
+	t.Run("ExtensionTypes", func(t *testing.T) {
+		// Without the imports the extension can only come from the types
+		file, err := protodesc.FileOptions{AllowUnresolvable: true}.New(fds.File[3], &protoregistry.Files{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		types := &protoregistry.Types{}
+		if err := types.RegisterExtension(dynamicpb.NewExtensionType(compiled[0].Extensions().Get(0))); err != nil {
+			t.Fatal(err)
+		}
+
+		outputMap := NewFileMap()
+		if err := PrintReflect(context.Background(), outputMap, []protoreflect.FileDescriptor{file}, Options{
+			ExtensionTypes: types,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		output, err := outputMap.GetFile("test/v1/test.proto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqualLines(t, strings.Split(files["test/v1/test.proto"], "\n"), strings.Split(string(output), "\n"))
+	})
+}
+
+// orderWriter records the order files are written in.
+type orderWriter struct {
+	fileMap
+	order []string
+}
+
+func (ow *orderWriter) PutFile(ctx context.Context, filename string, content []byte) error {
+	ow.order = append(ow.order, filename)
+	return ow.fileMap.PutFile(ctx, filename, content)
+}
+
+// blockingWriter calls first before writing the first file.
+type blockingWriter struct {
+	fileMap
+	first func()
+	once  sync.Once
+}
+
+func (bw *blockingWriter) PutFile(ctx context.Context, filename string, content []byte) error {
+	bw.once.Do(bw.first)
+	return bw.fileMap.PutFile(ctx, filename, content)
+}
+
+// readsFS records the files read from it.
+type readsFS struct {
+	files fstest.MapFS
+	mu    sync.Mutex
+	read  []string
+}
+
+func (rf *readsFS) Open(name string) (fs.File, error) {
+	rf.mu.Lock()
+	rf.read = append(rf.read, name)
+	rf.mu.Unlock()
+	return rf.files.Open(name)
+}
+
+func (rf *readsFS) reads() []string {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return slices.Clone(rf.read)
+}
+
+func TestConcurrentPrinting(t *testing.T) {
+	files := map[string]string{
+		"test/v1/ext.proto": strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import "google/protobuf/descriptor.proto";`,
+			`extend google.protobuf.MessageOptions {`,
+			`  bool sensitive = 50000;`,
+			`}`,
+		}, "\n"),
+	}
+	names := []string{}
+	for idx := 0; idx < 20; idx++ {
+		name := fmt.Sprintf("test/v1/file_%02d.proto", idx)
+		lines := []string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+		}
+		if idx%5 == 0 {
+			// uses an extension the printer will not know without the import
+			lines = append(lines, `import "test/v1/ext.proto";`, ``, fmt.Sprintf(`message Foo%d {`, idx), `  option (sensitive) = true;`, `}`, ``)
+		} else {
+			lines = append(lines, fmt.Sprintf(`message Foo%d {`, idx), `  string id = 1;`, `}`, ``)
+		}
+		files[name] = strings.Join(lines, "\n")
+		names = append(names, name)
+	}
+	compiled := compileFiles(t, files, names...)
+
+	t.Run("ordered", func(t *testing.T) {
+		out := &orderWriter{fileMap: NewFileMap()}
+		if err := PrintReflect(context.Background(), out, compiled, Options{
+			Concurrency: 4,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, names, out.order)
+		for _, name := range names {
+			assert.Equal(t, files[name], string(out.fileMap[name]))
+		}
+	})
+
+	// Without the imports, the extension options are unknown fields.
+	unresolved := make([]protoreflect.FileDescriptor, 0, len(compiled))
+	for _, file := range compiled {
+		raw, err := proto.Marshal(protodesc.ToFileDescriptorProto(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fdp := &descriptorpb.FileDescriptorProto{}
+		if err := proto.Unmarshal(raw, fdp); err != nil {
+			t.Fatal(err)
+		}
+		fd, err := protodesc.FileOptions{AllowUnresolvable: true}.New(fdp, &protoregistry.Files{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		unresolved = append(unresolved, fd)
+	}
+
+	t.Run("errors per file", func(t *testing.T) {
+		descriptors := unresolved
+		out := &orderWriter{fileMap: NewFileMap()}
+		err := PrintReflect(context.Background(), out, descriptors, Options{
+			Concurrency: 3,
+		})
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+
+		failed := []string{}
+		for _, fileErr := range err.(interface{ Unwrap() []error }).Unwrap() {
+			printErr := &Error{}
+			if !errors.As(fileErr, &printErr) {
+				t.Fatalf("expected an Error, got %v", fileErr)
+			}
+			failed = append(failed, printErr.Filename)
+		}
+		wantFailed := []string{}
+		wantWritten := []string{}
+		for idx, name := range names {
+			if idx%5 == 0 {
+				wantFailed = append(wantFailed, name)
+			} else {
+				wantWritten = append(wantWritten, name)
+			}
+		}
+		assert.Equal(t, wantFailed, failed)
+		assert.Equal(t, wantWritten, out.order)
+	})
+
+	t.Run("bounded ahead of the writer", func(t *testing.T) {
+		// Files with unknown extensions read their source when printed, which
+		// shows how far printing got while the first write is held up.
+		source := &readsFS{files: fstest.MapFS{}}
+		for _, name := range names {
+			source.files[name] = &fstest.MapFile{Data: []byte(files[name])}
+		}
+
+		var readWhileBlocked []string
+		out := &blockingWriter{
+			fileMap: NewFileMap(),
+			first: func() {
+				time.Sleep(100 * time.Millisecond)
+				readWhileBlocked = source.reads()
+			},
+		}
+		if err := PrintReflect(context.Background(), out, unresolved, Options{
+			Concurrency: 2,
+			Lenient:     true,
+			Source:      source,
+			OnWarning:   func(Warning) {},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Two workers print at most four files ahead, the first of which is
+		// the only one of those with an unknown extension.
+		assert.Equal(t, []string{"test/v1/file_00.proto"}, readWhileBlocked)
+		assert.Len(t, out.fileMap, len(names))
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		out := &orderWriter{fileMap: NewFileMap()}
+		err := PrintReflect(ctx, out, compiled, Options{
+			Concurrency: 4,
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+		assert.Empty(t, out.order)
+	})
+}
+
+func TestGroupOptions(t *testing.T) {
+	// Groups, and messages with delimited encoding, are set with the same
+	// literals as other messages.
+	t.Run("proto2", func(t *testing.T) {
+		assertRoundTrip(t, strings.Join([]string{
+			`syntax = "proto2";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "google/protobuf/descriptor.proto";`,
+			``,
+			`message Foo {`,
+			`  option (rule) = {`,
+			`    name: "foo"`,
+			`    Inner: {`,
+			`      count: 1`,
+			`    }`,
+			`  };`,
+			``,
+			`  message Bar {`,
+			`    option (rule).name = "bar";`,
+			`  }`,
+			`}`,
+			``,
+			`extend google.protobuf.MessageOptions {`,
+			`  optional group Rule = 50000 {`,
+			`    optional string name = 1;`,
+			``,
+			`    optional group Inner = 2 {`,
+			`      optional int32 count = 1;`,
+			`    }`,
+			`  }`,
+			`}`,
+			``,
+		}, "\n"))
+	})
+
+	t.Run("delimited", func(t *testing.T) {
+		assertRoundTrip(t, strings.Join([]string{
+			`edition = "2023";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "google/protobuf/descriptor.proto";`,
+			``,
+			`message Foo {`,
+			`  option (rule) = {`,
+			`    name: "foo"`,
+			`    inner: {`,
+			`      count: 1`,
+			`    }`,
+			`  };`,
+			`}`,
+			``,
+			`message Rule {`,
+			`  string name = 1;`,
+			`  Inner inner = 2 [features.message_encoding = DELIMITED];`,
+			``,
+			`  message Inner {`,
+			`    int32 count = 1;`,
+			`  }`,
+			`}`,
+			``,
+			`extend google.protobuf.MessageOptions {`,
+			`  Rule rule = 50000 [features.message_encoding = DELIMITED];`,
+			`}`,
+			``,
+		}, "\n"))
+	})
+}
+
+func TestFileFilters(t *testing.T) {
+	files := map[string]string{
+		"foo/v1/foo.proto":     "syntax = \"proto3\";\npackage foo.v1;\nmessage Foo {}\n",
+		"foo/v1/bar/bar.proto": "syntax = \"proto3\";\npackage foo.v1.bar;\nimport \"foo/v1/foo.proto\";\nmessage Bar { foo.v1.Foo foo = 1; }\n",
+		"foo/v10/foo.proto":    "syntax = \"proto3\";\npackage foo.v10;\nmessage Foo {}\n",
+		"baz/v1/baz.proto":     "syntax = \"proto3\";\npackage baz.v1;\nmessage Baz {}\n",
+	}
+	compiled := compileFiles(t, files, "foo/v1/foo.proto", "foo/v1/bar/bar.proto", "foo/v10/foo.proto", "baz/v1/baz.proto")
+
+	for _, tc := range []struct {
+		name    string
+		options Options
+		want    []string
+	}{{
+		name:    "all",
+		options: Options{},
+		want:    []string{"foo/v1/foo.proto", "foo/v1/bar/bar.proto", "foo/v10/foo.proto", "baz/v1/baz.proto"},
+	}, {
+		name:    "package segments",
+		options: Options{PackagePrefixes: []string{"foo.v1"}},
+		want:    []string{"foo/v1/foo.proto", "foo/v1/bar/bar.proto"},
+	}, {
+		name:    "filenames",
+		options: Options{OnlyFilenames: []string{"baz/v1/baz.proto", "foo/*/foo.proto"}},
+		want:    []string{"foo/v1/foo.proto", "foo/v10/foo.proto", "baz/v1/baz.proto"},
+	}, {
+		name: "both",
+		options: Options{
+			PackagePrefixes: []string{"foo.v1.bar", "baz"},
+			OnlyFilenames:   []string{"foo/v1/*/*.proto"},
+		},
+		want: []string{"foo/v1/bar/bar.proto"},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			outputMap := NewFileMap()
+			if err := PrintReflect(context.Background(), outputMap, compiled, tc.options); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, file := range compiled {
+				_, err := outputMap.GetFile(file.Path())
+				want := slices.Contains(tc.want, file.Path())
+				if want && err != nil {
+					t.Errorf("expected %s to be printed", file.Path())
+				} else if !want && err == nil {
+					t.Errorf("expected %s not to be printed", file.Path())
+				}
+			}
+		})
+	}
+}
+
+func TestOptionOrder(t *testing.T) {
+	file := func(methodOpts, messageOpts, fieldOpts []string) string {
+		lines := []string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "google/protobuf/descriptor.proto";`,
+			``,
+			`service Svc {`,
+			`  rpc Do(Msg) returns (Msg) {`,
+		}
+		for _, opt := range methodOpts {
+			lines = append(lines, "    option "+opt+";")
+		}
+		lines = append(lines,
+			`  }`,
+			`}`,
+			``,
+			`message Msg {`,
+		)
+		for idx, opt := range messageOpts {
+			if idx > 0 {
+				lines = append(lines, ``)
+			}
+			lines = append(lines, "  option "+opt+";")
+		}
+		lines = append(lines, ``, `  string id = 1 [`)
+		for idx, opt := range fieldOpts {
+			if idx < len(fieldOpts)-1 {
+				opt += ","
+			}
+			lines = append(lines, "    "+opt)
+		}
+		return strings.Join(append(lines,
+			`  ];`,
+			`}`,
+			``,
+			`extend google.protobuf.MessageOptions {`,
+			`  int32 zeta = 50001;`,
+			`  int32 alpha = 50002;`,
+			`}`,
+			``,
+			`extend google.protobuf.FieldOptions {`,
+			`  int32 field_zeta = 50001;`,
+			`  int32 field_alpha = 50002;`,
+			`}`,
+			``,
+			`extend google.protobuf.MethodOptions {`,
+			`  int32 method_zeta = 50001;`,
+			`  int32 method_alpha = 50002;`,
+			`}`,
+			``,
+		), "\n")
+	}
+
+	src := file(
+		[]string{"(method_zeta) = 1", "deprecated = true", "(method_alpha) = 2"},
+		[]string{"(zeta) = 1", "deprecated = true", "(alpha) = 2"},
+		[]string{"(field_zeta) = 1", `json_name = "ident"`, "deprecated = true", "(field_alpha) = 2"},
+	)
+	compiled := compileFiles(t, map[string]string{"test.proto": src}, "test.proto")
+
+	for _, tc := range []struct {
+		name  string
+		order OptionOrder
+		want  string
+	}{{
+		name:  "source",
+		order: OptionOrderSource,
+		want:  src,
+	}, {
+		name:  "alphabetical",
+		order: OptionOrderAlphabetical,
+		want: file(
+			[]string{"(method_alpha) = 2", "(method_zeta) = 1", "deprecated = true"},
+			[]string{"(alpha) = 2", "(zeta) = 1", "deprecated = true"},
+			[]string{`json_name = "ident"`, "(field_alpha) = 2", "(field_zeta) = 1", "deprecated = true"},
+		),
+	}, {
+		name:  "field number",
+		order: OptionOrderFieldNumber,
+		want: file(
+			[]string{"deprecated = true", "(method_zeta) = 1", "(method_alpha) = 2"},
+			[]string{"deprecated = true", "(zeta) = 1", "(alpha) = 2"},
+			[]string{`json_name = "ident"`, "deprecated = true", "(field_zeta) = 1", "(field_alpha) = 2"},
+		),
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			outputMap := NewFileMap()
+			if err := PrintReflect(context.Background(), outputMap, compiled, Options{
+				OptionOrder: tc.order,
+			}); err != nil {
+				t.Fatal(err)
+			}
+			output, err := outputMap.GetFile("test.proto")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqualLines(t, strings.Split(tc.want, "\n"), strings.Split(string(output), "\n"))
+		})
+	}
+}
+
+func TestPreserveOptionShape(t *testing.T) {
+	src := strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/descriptor.proto";`,
+		``,
+		`message Foo {`,
+		`  option (rule).name = "foo";`,
+		``,
+		`  option (rule).inner.count = 1;`,
+		``,
+		`  option (rule).tags = "a";`,
+		``,
+		`  option (rule).tags = "b";`,
+		``,
+		`  option (other) = {`,
+		`    inner: {`,
+		`      count: 2`,
+		`    }`,
+		`  };`,
+		``,
+		`  option (mixed) = {`,
+		`    name: "m"`,
+		`    tags: ["x"]`,
+		`  };`,
+		``,
+		`  option (mixed).inner.count = 3;`,
+		``,
+		`  option (mixed).tags = "y";`,
+		``,
+		`  string id = 1 [`,
+		`    (field_rule).name = "x",`,
+		`    (field_rule).inner = {count: 4}`,
+		`  ];`,
+		`}`,
+		``,
+		`message Rule {`,
+		`  string name = 1;`,
+		`  Inner inner = 2;`,
+		`  repeated string tags = 3;`,
+		``,
+		`  message Inner {`,
+		`    int32 count = 1;`,
+		`  }`,
+		`}`,
+		``,
+		`extend google.protobuf.MessageOptions {`,
+		`  Rule rule = 50000;`,
+		`  Rule other = 50001;`,
+		`  Rule mixed = 50002;`,
+		`}`,
+		``,
+		`extend google.protobuf.FieldOptions {`,
+		`  Rule field_rule = 50000;`,
+		`}`,
+		``,
+	}, "\n")
+	compiled := compileFiles(t, map[string]string{"test.proto": src}, "test.proto")
+
+	printWith := func(t *testing.T, opts Options) string {
+		t.Helper()
+		outputMap := NewFileMap()
+		if err := PrintReflect(context.Background(), outputMap, compiled, opts); err != nil {
+			t.Fatal(err)
+		}
+		output, err := outputMap.GetFile("test.proto")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Verify(context.Background(), compiled[0], output); err != nil {
+			t.Fatal(err)
+		}
+		return string(output)
+	}
+
+	t.Run("preserved", func(t *testing.T) {
+		output := printWith(t, Options{PreserveOptionShape: true})
+		assertEqualLines(t, strings.Split(src, "\n"), strings.Split(output, "\n"))
+	})
+
+	t.Run("default", func(t *testing.T) {
+		output := printWith(t, Options{})
+		assert.Contains(t, output, "  option (rule) = {\n")
+		assert.Contains(t, output, "  option (other).inner.count = 2;\n")
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	file := func(options ...string) string {
+		lines := []string{
+			`syntax = "proto3";`,
+			``,
+			`package test.v1;`,
+			``,
+			`import "google/protobuf/descriptor.proto";`,
+			``,
+			`message Foo {`,
+		}
+		for idx, opt := range options {
+			if idx > 0 && strings.HasPrefix(opt, "option ") {
+				lines = append(lines, ``)
+			}
+			lines = append(lines, "  "+opt)
+		}
+		return strings.Join(append(lines,
+			`}`,
+			``,
+			`message Rule {`,
+			`  Inner inner = 1;`,
+			`  string b = 3;`,
+			`  string a = 2;`,
+			``,
+			`  message Inner {`,
+			`    Deep deep = 1;`,
+			`  }`,
+			``,
+			`  message Deep {`,
+			`    int32 count = 1;`,
+			`  }`,
+			`}`,
+			``,
+			`extend google.protobuf.MessageOptions {`,
+			`  Rule shallow = 50000;`,
+			`  Rule literal = 50001;`,
+			`  Rule inline = 50002;`,
+			`  Rule ordered = 50003;`,
+			`}`,
+			``,
+		), "\n")
+	}
+
+	src := file(
+		`option (shallow).inner.deep.count = 1;`,
+		`option (literal).inner.deep.count = 2;`,
+		`option (inline) = {`,
+		`  b: "b"`,
+		`  a: "a"`,
+		`};`,
+		`option (ordered) = {`,
+		`  b: "b"`,
+		`  a: "a"`,
+		`  inner: {`,
+		`    deep: {`,
+		`      count: 3`,
+		`    }`,
+		`  }`,
+		`};`,
+	)
+	compiled := compileFiles(t, map[string]string{"test.proto": src}, "test.proto")
+
+	policy, err := ParsePolicy([]byte(strings.Join([]string{
+		`options:`,
+		`  test.v1.shallow:`,
+		`    maxDepth: 1`,
+		`  test.v1.literal:`,
+		`    aggregate: true`,
+		`  test.v1.inline:`,
+		`    inlineFields: 2`,
+		`  test.v1.ordered:`,
+		`    fieldOrder: name`,
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, OptionPolicy{Aggregate: true}, policy.Options["google.api.http"], "defaults are kept")
+
+	outputMap := NewFileMap()
+	if err := PrintReflect(context.Background(), outputMap, compiled, Options{Policy: policy}); err != nil {
+		t.Fatal(err)
+	}
+	output, err := outputMap.GetFile("test.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(context.Background(), compiled[0], output); err != nil {
+		t.Fatal(err)
+	}
+
+	want := file(
+		`option (shallow).inner = {`,
+		`  deep: {`,
+		`    count: 1`,
+		`  }`,
+		`};`,
+		`option (literal) = {`,
+		`  inner: {`,
+		`    deep: {`,
+		`      count: 2`,
+		`    }`,
+		`  }`,
+		`};`,
+		`option (inline) = {b: "b", a: "a"};`,
+		`option (ordered) = {`,
+		`  a: "a"`,
+		`  b: "b"`,
+		`  inner: {`,
+		`    deep: {`,
+		`      count: 3`,
+		`    }`,
+		`  }`,
+		`};`,
+	)
+	assertEqualLines(t, strings.Split(want, "\n"), strings.Split(string(output), "\n"))
+
+	for _, bad := range []string{
+		"options:\n  foo:\n    fieldOrder: random\n",
+		"options:\n  foo:\n    unknown: true\n",
+		"options:\n  foo:\n    maxDepth: -1\n",
+	} {
+		if _, err := ParsePolicy([]byte(bad)); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	src := strings.Join([]string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`import "google/protobuf/empty.proto";`,
+		`import public "google/protobuf/timestamp.proto";`,
+		``,
+		`message Foo {`,
+		`  string name = 1 [json_name = "fooName"];`,
+		`  int32 count = 2;`,
+		``,
+		`  reserved 3, 4;`,
+		`  reserved 5;`,
+		`}`,
+		``,
+		`service FooService {`,
+		`  rpc Watch(google.protobuf.Empty) returns (stream Foo) {`,
+		`    option deprecated = true;`,
+		`  }`,
+		`}`,
+		``,
+	}, "\n")
+
+	input := compileFiles(t, map[string]string{"test.proto": src}, "test.proto")[0]
+
+	for _, tc := range []struct {
+		name    string
+		printed string
+		diffs   []string
+	}{{
+		name: "equivalent",
+		printed: strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import public "google/protobuf/timestamp.proto";`,
+			`import "google/protobuf/empty.proto";`,
+			`service FooService {`,
+			`  rpc Watch(google.protobuf.Empty) returns (stream Foo) { option deprecated = true; }`,
+			`}`,
+			`message Foo {`,
+			`  reserved 3 to 5;`,
+			`  string name = 1 [json_name = "fooName"];`,
+			`  int32 count = 2;`,
+			`}`,
+		}, "\n"),
+	}, {
+		name: "reordered fields",
+		printed: strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import "google/protobuf/empty.proto";`,
+			`import public "google/protobuf/timestamp.proto";`,
+			`message Foo {`,
+			`  int32 count = 2;`,
+			`  string name = 1 [json_name = "fooName"];`,
+			`  reserved 3 to 5;`,
+			`}`,
+			`service FooService {`,
+			`  rpc Watch(google.protobuf.Empty) returns (stream Foo) { option deprecated = true; }`,
+			`}`,
+		}, "\n"),
+		diffs: []string{
+			`message_type[Foo].field: order is [name, count] in the original, printed [count, name]`,
+		},
+	}, {
+		name: "changes",
+		printed: strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import "google/protobuf/empty.proto";`,
+			`import "google/protobuf/timestamp.proto";`,
+			`message Foo {`,
+			`  string name = 1;`,
+			`  int64 count = 2;`,
+			`  reserved 3;`,
+			`}`,
+			`service FooService {`,
+			`  rpc Watch(google.protobuf.Empty) returns (Foo);`,
+			`}`,
+		}, "\n"),
+		diffs: []string{
+			`public_dependency: [1] in the original, not set in printed`,
+			`message_type[Foo].field[name].json_name: "fooName" in the original, not set in printed`,
+			`message_type[Foo].field[count].type: TYPE_INT32 in the original, printed TYPE_INT64`,
+			`message_type[Foo].reserved_range[0].end: 6 in the original, printed 4`,
+			`service[FooService].method[Watch].options: {...} in the original, not set in printed`,
+			`service[FooService].method[Watch].server_streaming: true in the original, not set in printed`,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Verify(context.Background(), input, []byte(tc.printed))
+			if len(tc.diffs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			verifyErr := &VerifyError{}
+			if !errors.As(err, &verifyErr) {
+				t.Fatalf("expected a VerifyError, got %v", err)
+			}
+			assert.Equal(t, tc.diffs, verifyErr.Diffs)
+		})
+	}
+}
+
+func TestVerifyOptionValues(t *testing.T) {
+	printed := func(rule string) string {
+		return strings.Join([]string{
+			`syntax = "proto3";`,
+			`package test.v1;`,
+			`import "google/protobuf/descriptor.proto";`,
+			`message Rule {`,
+			`  int32 min = 1;`,
+			`  repeated string tags = 2;`,
+			`}`,
+			`extend google.protobuf.FieldOptions {`,
+			`  Rule rule = 50001;`,
+			`  string label = 50002;`,
+			`}`,
+			`message Foo {`,
+			`  int32 count = 1 [` + rule + `];`,
+			`}`,
+			``,
+		}, "\n")
+	}
+
+	input := compileFiles(t, map[string]string{
+		"test.proto": printed(`(rule) = {min: 1, tags: ["a", "b"]}, (label) = "count"`),
+	}, "test.proto")[0]
+
+	for _, tc := range []struct {
+		name  string
+		rule  string
+		diffs []string
+	}{{
+		name: "reordered",
+		rule: `(label) = "count", (rule).tags = "a", (rule).min = 1, (rule).tags = "b"`,
+	}, {
+		name: "changed",
+		rule: `(rule) = {min: 2, tags: ["a", "c"]}`,
+		diffs: []string{
+			`message_type[Foo].field[count].options.(test.v1.rule).min: 1 in the original, printed 2`,
+			`message_type[Foo].field[count].options.(test.v1.rule).tags: ["a", "b"] in the original, printed ["a", "c"]`,
+			`message_type[Foo].field[count].options.(test.v1.label): "count" in the original, not set in printed`,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := Verify(context.Background(), input, []byte(printed(tc.rule)))
+			if len(tc.diffs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			verifyErr := &VerifyError{}
+			if !errors.As(err, &verifyErr) {
+				t.Fatalf("expected a VerifyError, got %v", err)
+			}
+			assert.Equal(t, tc.diffs, verifyErr.Diffs)
+		})
+	}
+}
+
+func BenchmarkPrintLargeFile(b *testing.B) {
+	lines := []string{
+		`syntax = "proto3";`,
+		``,
+		`package test.v1;`,
+		``,
+		`message Large {`,
+	}
+	for num := 1; num <= 5000; num++ {
+		lines = append(lines, fmt.Sprintf(`  string field_%d = %d [deprecated = true, json_name = "f%d"];`, num, num, num))
+	}
+	lines = append(lines, `}`, ``)
+	file := compileFiles(b, map[string]string{"test.proto": strings.Join(lines, "\n")}, "test.proto")[0]
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := printFile(file, optionreflect.NewBuilder(nil)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package protoprint
+
+import (
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// refName returns the name to print for a reference from within scope to the
+// referenced element. It is the shortest suffix of the full name which the
+// compiler resolves back to the same element, following protobuf's scoping
+// rules, or the full name with a leading dot when no suffix does.
+//
+// References to elements in other packages start from the full name, so they
+// read as the package and the name within it.
+//
+// scope is the element the reference is resolved from: a message or service
+// to search its nested names first, or the file. onlyTypes is set for field
+// types, which skip over names of things which are not messages or enums.
+func (fb *fileBuilder) refName(scope protoreflect.Descriptor, ref protoreflect.Descriptor, onlyTypes bool) string {
+	full := string(ref.FullName())
+	if ref.IsPlaceholder() {
+		// not in the files, so there is nothing to resolve against
+		return full
+	}
+	parts := strings.Split(full, ".")
+
+	shortest := 1
+	if scope.ParentFile().Package() != ref.ParentFile().Package() {
+		shortest = len(parts)
+	}
+
+	res := fb.out.printer.resolver(scope, onlyTypes)
+	res.include(ref.ParentFile())
+	for n := shortest; n <= len(parts); n++ {
+		name := strings.Join(parts[len(parts)-n:], ".")
+		if found := res.resolve(name); found.desc != nil && found.desc.FullName() == ref.FullName() {
+			return name
+		}
+	}
+	return "." + full
+}
+
+// symbols are the elements declared in a file, by full name.
+type symbols map[protoreflect.FullName]protoreflect.Descriptor
+
+func fileSymbols(file protoreflect.FileDescriptor) symbols {
+	syms := symbols{}
+	add := func(desc protoreflect.Descriptor) {
+		syms[desc.FullName()] = desc
+	}
+	addEnums := func(enums protoreflect.EnumDescriptors) {
+		for idx := 0; idx < enums.Len(); idx++ {
+			enum := enums.Get(idx)
+			add(enum)
+			values := enum.Values()
+			for vIdx := 0; vIdx < values.Len(); vIdx++ {
+				// enum values are scoped to the enum's parent
+				add(values.Get(vIdx))
+			}
+		}
+	}
+	addFields := func(fields protoreflect.ExtensionDescriptors) {
+		for idx := 0; idx < fields.Len(); idx++ {
+			add(fields.Get(idx))
+		}
+	}
+	var addMessages func(msgs protoreflect.MessageDescriptors)
+	addMessages = func(msgs protoreflect.MessageDescriptors) {
+		for idx := 0; idx < msgs.Len(); idx++ {
+			msg := msgs.Get(idx)
+			add(msg)
+			addFields(msg.Fields())
+			oneofs := msg.Oneofs()
+			for oIdx := 0; oIdx < oneofs.Len(); oIdx++ {
+				add(oneofs.Get(oIdx))
+			}
+			addFields(msg.Extensions())
+			addEnums(msg.Enums())
+			addMessages(msg.Messages())
+		}
+	}
+
+	addMessages(file.Messages())
+	addEnums(file.Enums())
+	addFields(file.Extensions())
+	services := file.Services()
+	for idx := 0; idx < services.Len(); idx++ {
+		svc := services.Get(idx)
+		add(svc)
+		methods := svc.Methods()
+		for mIdx := 0; mIdx < methods.Len(); mIdx++ {
+			add(methods.Get(mIdx))
+		}
+	}
+	return syms
+}
+
+// symbolsFor returns the symbols of the file, built once per file.
+func (fp *filePrinter) symbolsFor(file protoreflect.FileDescriptor) symbols {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if syms, ok := fp.symbols[file.Path()]; ok {
+		return syms
+	}
+	syms := fileSymbols(file)
+	fp.symbols[file.Path()] = syms
+	return syms
+}
+
+// nameResolver resolves names the way the compiler does from one scope.
+type nameResolver struct {
+	printer *filePrinter
+
+	// files are visible from the scope: the file, its imports, and the files
+	// those publicly import.
+	files []protoreflect.FileDescriptor
+
+	// scopes are the full names of the enclosing messages and services, the
+	// innermost last.
+	scopes    []protoreflect.FullName
+	pkg       protoreflect.FullName
+	onlyTypes bool
+}
+
+func (fp *filePrinter) resolver(scope protoreflect.Descriptor, onlyTypes bool) *nameResolver {
+	file := scope.ParentFile()
+	res := &nameResolver{
+		printer:   fp,
+		files:     visibleFiles(file),
+		pkg:       file.Package(),
+		onlyTypes: onlyTypes,
+	}
+	for desc := scope; desc != nil && desc != protoreflect.Descriptor(file); desc = desc.Parent() {
+		switch desc := desc.(type) {
+		case protoreflect.MessageDescriptor:
+			if desc.IsMapEntry() {
+				// map types are resolved from the message holding the field
+				continue
+			}
+		case protoreflect.ServiceDescriptor:
+		default:
+			continue
+		}
+		res.scopes = append([]protoreflect.FullName{desc.FullName()}, res.scopes...)
+	}
+	return res
+}
+
+func visibleFiles(file protoreflect.FileDescriptor) []protoreflect.FileDescriptor {
+	files := []protoreflect.FileDescriptor{file}
+	seen := map[string]struct{}{file.Path(): {}}
+	var addImport func(imp protoreflect.FileImport)
+	addImport = func(imp protoreflect.FileImport) {
+		if imp.FileDescriptor == nil {
+			return
+		}
+		if _, ok := seen[imp.Path()]; ok {
+			return
+		}
+		seen[imp.Path()] = struct{}{}
+		files = append(files, imp.FileDescriptor)
+		imports := imp.Imports()
+		for idx := 0; idx < imports.Len(); idx++ {
+			if pub := imports.Get(idx); pub.IsPublic {
+				addImport(pub)
+			}
+		}
+	}
+	imports := file.Imports()
+	for idx := 0; idx < imports.Len(); idx++ {
+		addImport(imports.Get(idx))
+	}
+	return files
+}
+
+// include makes the file visible when the import of it is a placeholder, or
+// missing, e.g. for extensions from Options.ExtensionTypes.
+func (res *nameResolver) include(file protoreflect.FileDescriptor) {
+	for idx, visible := range res.files {
+		if visible.Path() == file.Path() {
+			if visible.IsPlaceholder() {
+				res.files[idx] = file
+			}
+			return
+		}
+	}
+	res.files = append(res.files, file)
+}
+
+// symbol is what a name resolves to, an element or a package namespace.
+type symbol struct {
+	desc      protoreflect.Descriptor
+	namespace bool
+}
+
+func (s symbol) found() bool {
+	return s.desc != nil || s.namespace
+}
+
+// aggregate is true for names which can be the first part of a longer name.
+func (s symbol) aggregate() bool {
+	if s.namespace {
+		return true
+	}
+	switch s.desc.(type) {
+	case protoreflect.MessageDescriptor, protoreflect.EnumDescriptor, protoreflect.ServiceDescriptor:
+		return true
+	}
+	return false
+}
+
+func (s symbol) isType() bool {
+	switch s.desc.(type) {
+	case protoreflect.MessageDescriptor, protoreflect.EnumDescriptor:
+		return true
+	}
+	return false
+}
+
+// lookup finds the full name in the files, the first file which declares it,
+// or has a package within it, wins.
+func (res *nameResolver) lookup(files []protoreflect.FileDescriptor, name string) symbol {
+	for _, file := range files {
+		if desc, ok := res.printer.symbolsFor(file)[protoreflect.FullName(name)]; ok {
+			return symbol{desc: desc}
+		}
+		pkg := string(file.Package())
+		if pkg == name || strings.HasPrefix(pkg, name+".") {
+			return symbol{namespace: true}
+		}
+	}
+	return symbol{}
+}
+
+// resolve returns what the name refers to from the scope. A name which is
+// found in a scope, but does not resolve there, is an error for the compiler
+// rather than a reason to look further out, so resolves to nothing.
+func (res *nameResolver) resolve(name string) symbol {
+	first, _, compound := strings.Cut(name, ".")
+
+	// Nested names are only declared in the file with the message or service.
+	local := res.files[:1]
+	for idx := len(res.scopes) - 1; idx >= 0; idx-- {
+		prefix := string(res.scopes[idx])
+		found, stop := res.resolveRelative(local, prefix+"."+first, prefix+"."+name)
+		if stop {
+			return found
+		}
+		if found.found() && (!res.onlyTypes || found.isType() || compound) {
+			return found
+		}
+	}
+
+	// The package, then each parent package. At the root the name is looked up
+	// whole.
+	pkg := string(res.pkg)
+	for {
+		var found symbol
+		var stop bool
+		if pkg == "" {
+			found = res.lookup(res.files, name)
+		} else {
+			found, stop = res.resolveRelative(res.files, pkg+"."+first, pkg+"."+name)
+		}
+		if stop || found.found() {
+			if !res.onlyTypes || found.isType() || compound {
+				return found
+			}
+			return symbol{}
+		}
+		if pkg == "" {
+			return symbol{}
+		}
+		pkg, _ = cutLast(pkg)
+	}
+}
+
+// resolveRelative looks up the first part of the name, then the whole name
+// within it. stop is set when the first part is found but the name is not.
+func (res *nameResolver) resolveRelative(files []protoreflect.FileDescriptor, first, name string) (found symbol, stop bool) {
+	found = res.lookup(files, first)
+	if !found.found() || first == name {
+		return found, false
+	}
+	if !found.aggregate() {
+		// e.g. a field with the same name as the first part, which is skipped
+		return symbol{}, false
+	}
+	found = res.lookup(files, name)
+	return found, !found.found()
+}
+
+func cutLast(name string) (string, string) {
+	idx := strings.LastIndex(name, ".")
+	if idx < 0 {
+		return "", name
+	}
+	return name[:idx], name[idx+1:]
+}
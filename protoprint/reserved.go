@@ -0,0 +1,285 @@
+package protoprint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/pentops/prototools/optionreflect"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// rangeStatement is a 'reserved' or 'extensions' statement, which is not a
+// descriptor, but still sits between the fields or values of its parent.
+type rangeStatement struct {
+	keyword string
+	ranges  [][2]int64 // inclusive
+	names   []string
+	max     int64
+
+	// Editions use identifiers for reserved names, older syntax uses strings.
+	identifierNames bool
+
+	// message is set for 'extensions' statements, which print the options of
+	// the extension range at rangeIndex. Each range in the statement has the
+	// same options.
+	message    protoreflect.MessageDescriptor
+	rangeIndex int
+
+	location protoreflect.SourceLocation
+}
+
+func (fb *fileBuilder) printRangeStatement(stmt *rangeStatement) error {
+	var options []parsedOption
+	if stmt.message != nil {
+		var err error
+		options, err = fb.extensionRangeOptions(stmt.message, stmt.rangeIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	parts := make([]string, 0, len(stmt.ranges)+len(stmt.names))
+	for _, rr := range collapseRanges(stmt.ranges) {
+		start := fmt.Sprint(rr[0])
+		end := fmt.Sprint(rr[1])
+		if rr[1] == stmt.max {
+			end = "max"
+		}
+		if rr[0] == rr[1] {
+			parts = append(parts, start)
+		} else {
+			parts = append(parts, fmt.Sprintf("%s to %s", start, end))
+		}
+	}
+	for _, name := range stmt.names {
+		if stmt.identifierNames {
+			parts = append(parts, name)
+		} else {
+			parts = append(parts, optionreflect.QuoteString(name))
+		}
+	}
+
+	fb.printWithOptions(stmt.keyword+" "+strings.Join(parts, ", "), options, stmt.location)
+	return nil
+}
+
+// collapseRanges merges consecutive ranges which are contiguous, so that
+// 1, 2, 3 becomes 1 to 3
+func collapseRanges(ranges [][2]int64) [][2]int64 {
+	out := make([][2]int64, 0, len(ranges))
+	for _, rr := range ranges {
+		if len(out) > 0 && out[len(out)-1][1]+1 == rr[0] {
+			out[len(out)-1][1] = rr[1]
+			continue
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+func (fb *fileBuilder) messageReservedStatements(msg protoreflect.MessageDescriptor) []*rangeStatement {
+	ranges := msg.ReservedRanges()
+	rangeValues := make([][2]int64, ranges.Len())
+	for idx := 0; idx < ranges.Len(); idx++ {
+		rr := ranges.Get(idx)
+		// message ranges are exclusive of the end
+		rangeValues[idx] = [2]int64{int64(rr[0]), int64(rr[1]) - 1}
+	}
+
+	// field 9 of DescriptorProto is reserved_range, 10 is reserved_name
+	return fb.reservedStatements(msg, rangeValues, msg.ReservedNames(), 9, 10, int64(protowire.MaxValidNumber))
+}
+
+func (fb *fileBuilder) enumReservedStatements(enum protoreflect.EnumDescriptor) []*rangeStatement {
+	ranges := enum.ReservedRanges()
+	rangeValues := make([][2]int64, ranges.Len())
+	for idx := 0; idx < ranges.Len(); idx++ {
+		rr := ranges.Get(idx)
+		// enum ranges are inclusive of the end
+		rangeValues[idx] = [2]int64{int64(rr[0]), int64(rr[1])}
+	}
+
+	// field 4 of EnumDescriptorProto is reserved_range, 5 is reserved_name
+	return fb.reservedStatements(enum, rangeValues, enum.ReservedNames(), 4, 5, math.MaxInt32)
+}
+
+func (fb *fileBuilder) reservedStatements(parent protoreflect.Descriptor, ranges [][2]int64, names protoreflect.Names, rangeField, nameField int32, max int64) []*rangeStatement {
+	statements := make([]*rangeStatement, 0)
+
+	for _, group := range fb.groupByStatement(parent, rangeField, len(ranges)) {
+		stmt := &rangeStatement{
+			keyword:  "reserved",
+			max:      max,
+			location: group.location,
+		}
+		for _, idx := range group.indexes {
+			stmt.ranges = append(stmt.ranges, ranges[idx])
+		}
+		statements = append(statements, stmt)
+	}
+
+	for _, group := range fb.groupByStatement(parent, nameField, names.Len()) {
+		stmt := &rangeStatement{
+			keyword:         "reserved",
+			location:        group.location,
+			identifierNames: parent.Syntax() == protoreflect.Editions,
+		}
+		for _, idx := range group.indexes {
+			stmt.names = append(stmt.names, string(names.Get(idx)))
+		}
+		statements = append(statements, stmt)
+	}
+
+	return statements
+}
+
+func (fb *fileBuilder) extensionRangeStatements(msg protoreflect.MessageDescriptor) []*rangeStatement {
+	ranges := msg.ExtensionRanges()
+	statements := make([]*rangeStatement, 0)
+
+	max := int64(protowire.MaxValidNumber)
+	if isMessageSet(msg) {
+		// message sets allow any positive int32, excluding the max
+		max = math.MaxInt32 - 1
+	}
+
+	// field 5 of DescriptorProto is extension_range
+	for _, group := range fb.groupByStatement(msg, 5, ranges.Len()) {
+		var stmt *rangeStatement
+		for _, idx := range group.indexes {
+			// The options apply to every range of a statement, ranges with
+			// different options need statements of their own, which happens
+			// when there is no source info to group them.
+			if stmt == nil || !proto.Equal(msg.ExtensionRangeOptions(stmt.rangeIndex), msg.ExtensionRangeOptions(idx)) {
+				stmt = &rangeStatement{
+					keyword:    "extensions",
+					max:        max,
+					message:    msg,
+					rangeIndex: idx,
+				}
+				if stmt.rangeIndex == group.indexes[0] {
+					// Comments belong to the first of the statements.
+					stmt.location = group.location
+				}
+				statements = append(statements, stmt)
+			}
+			rr := ranges.Get(idx)
+			// extension ranges are exclusive of the end
+			stmt.ranges = append(stmt.ranges, [2]int64{int64(rr[0]), int64(rr[1]) - 1})
+		}
+	}
+	return statements
+}
+
+type statementGroup struct {
+	location protoreflect.SourceLocation
+	indexes  []int
+}
+
+// groupByStatement splits the items of a repeated field in the parent
+// descriptor by the source statement they were declared in. The items of one
+// field may be spread across multiple statements, e.g. 'reserved 1; reserved
+// 2;' both add to reserved_range. Without source info, all items are placed in
+// a single group.
+func (fb *fileBuilder) groupByStatement(parent protoreflect.Descriptor, fieldNumber int32, count int) []statementGroup {
+	if count == 0 {
+		return nil
+	}
+
+	sourceLocations := parent.ParentFile().SourceLocations()
+	parentPath := sourceLocations.ByDescriptor(parent).Path
+
+	statementPath := make(protoreflect.SourcePath, len(parentPath), len(parentPath)+2)
+	copy(statementPath, parentPath)
+	statementPath = append(statementPath, fieldNumber)
+
+	statements := fb.out.printer.statementsFor(parent.ParentFile())[pathKey(statementPath)]
+
+	groups := make([]statementGroup, 0)
+	groupForStatement := map[int]int{}
+
+	for idx := 0; idx < count; idx++ {
+		itemLoc := sourceLocations.ByPath(append(statementPath, int32(idx)))
+
+		statementIdx := -1
+		for stmtIdx, stmt := range statements {
+			if containsLocation(stmt, itemLoc) {
+				statementIdx = stmtIdx
+				break
+			}
+		}
+
+		groupIdx, ok := groupForStatement[statementIdx]
+		if !ok {
+			group := statementGroup{}
+			if statementIdx >= 0 {
+				group.location = statements[statementIdx]
+			}
+			groupIdx = len(groups)
+			groups = append(groups, group)
+			groupForStatement[statementIdx] = groupIdx
+		}
+		groups[groupIdx].indexes = append(groups[groupIdx].indexes, idx)
+	}
+
+	return groups
+}
+
+// statementIndex holds the source locations of a file by path. Unlike
+// SourceLocations.ByPath it keeps every location with the path, as the items
+// of one field may be declared by several statements.
+type statementIndex map[string][]protoreflect.SourceLocation
+
+func newStatementIndex(file protoreflect.FileDescriptor) statementIndex {
+	index := statementIndex{}
+	locs := file.SourceLocations()
+	for idx := 0; idx < locs.Len(); idx++ {
+		loc := locs.Get(idx)
+		key := pathKey(loc.Path)
+		index[key] = append(index[key], loc)
+	}
+	return index
+}
+
+func pathKey(path protoreflect.SourcePath) string {
+	key := make([]byte, 0, len(path)*4)
+	for _, part := range path {
+		key = binary.LittleEndian.AppendUint32(key, uint32(part))
+	}
+	return string(key)
+}
+
+// statementsFor returns the statement index of the file, built once per file.
+func (fp *filePrinter) statementsFor(file protoreflect.FileDescriptor) statementIndex {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if index, ok := fp.statements[file.Path()]; ok {
+		return index
+	}
+	index := newStatementIndex(file)
+	if fp.statements == nil {
+		fp.statements = map[string]statementIndex{}
+	}
+	fp.statements[file.Path()] = index
+	return index
+}
+
+func containsLocation(outer, inner protoreflect.SourceLocation) bool {
+	if outer.StartLine > inner.StartLine || (outer.StartLine == inner.StartLine && outer.StartColumn > inner.StartColumn) {
+		return false
+	}
+	if outer.EndLine < inner.EndLine || (outer.EndLine == inner.EndLine && outer.EndColumn < inner.EndColumn) {
+		return false
+	}
+	return true
+}
+
+func isMessageSet(msg protoreflect.MessageDescriptor) bool {
+	options := msg.Options().ProtoReflect()
+	field := options.Descriptor().Fields().ByName("message_set_wire_format")
+	return field != nil && options.Get(field).Bool()
+}
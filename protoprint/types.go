@@ -3,30 +3,36 @@ package protoprint
 import (
 	"fmt"
 	"sort"
+	"strings"
 
 	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 func (fb *fileBuilder) printSection(typeName string, wrapper protoreflect.Descriptor, elements sourceElements) error {
+	return fb.printBlock(fmt.Sprintf("%s %s", typeName, wrapper.Name()), wrapper, elements)
+}
+
+func (fb *fileBuilder) printBlock(header string, wrapper protoreflect.Descriptor, elements sourceElements) error {
 
 	sort.Sort(elements)
 
 	sourceLocation := wrapper.ParentFile().SourceLocations().ByDescriptor(wrapper)
 
-	extensions, err := fb.out.extensions.OptionsFor(wrapper)
+	extensions, err := fb.optionsFor(wrapper)
 	if err != nil {
 		return err
 	}
 
 	fb.leadingComments(sourceLocation)
 
-	if len(elements) == 0 && len(extensions) == 0 {
-		fb.p(typeName, " ", wrapper.Name(), " {}", inlineComment(sourceLocation))
-		fb.trailingComments(sourceLocation)
+	// The trailing comment of a block follows the opening brace, so a block
+	// with one is never collapsed.
+	if len(elements) == 0 && len(extensions) == 0 && sourceLocation.TrailingComments == "" {
+		fb.p(header, " {}")
 		return nil
 	}
 
-	fb.p(typeName, " ", wrapper.Name(), " {", inlineComment(sourceLocation))
+	fb.p(header, " {", inlineComment(sourceLocation))
 	ind := fb.indent()
 	ind.trailingComments(sourceLocation)
 
@@ -62,48 +68,62 @@ func (fb *fileBuilder) printElements(elements sourceElements) error {
 		lastEnd = element.sourceLocation.EndLine
 		lastType = element.typeOrder
 
+		if element.statement != nil {
+			if err := fb.printRangeStatement(element.statement); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if element.extension != nil {
+			if err := fb.printExtension(*element.extension); err != nil {
+				return err
+			}
+			continue
+		}
+
 		switch et := element.descriptor.(type) {
 		case protoreflect.MessageDescriptor:
 			if err := fb.printMessage(et); err != nil {
-				return err
+				return elementError(et, err)
 			}
 			fb.addGap()
 
 		case protoreflect.ServiceDescriptor:
 			if err := fb.printService(et); err != nil {
-				return err
+				return elementError(et, err)
 			}
 			fb.addGap()
 
 		case protoreflect.EnumDescriptor:
 			if err := fb.printEnum(et); err != nil {
-				return err
+				return elementError(et, err)
 			}
 			fb.addGap()
 
 		case protoreflect.OneofDescriptor:
 			if err := fb.printOneof(et); err != nil {
-				return err
+				return elementError(et, err)
 			}
 			fb.addGap()
 
 		case protoreflect.FieldDescriptor:
 			if err := fb.printField(et); err != nil {
-				return err
+				return elementError(et, err)
 			}
 
 		case protoreflect.EnumValueDescriptor:
 			if err := fb.printEnumValue(et); err != nil {
-				return err
+				return elementError(et, err)
 			}
 
 		case protoreflect.MethodDescriptor:
 			if err := fb.printMethod(et); err != nil {
-				return err
+				return elementError(et, err)
 			}
 
 		default:
-			return fmt.Errorf("unknown element type %T", et)
+			return elementError(element.descriptor, fmt.Errorf("unknown element type %T", et))
 		}
 
 	}
@@ -125,6 +145,11 @@ func (fb *fileBuilder) printEnum(enum protoreflect.EnumDescriptor) error {
 	for idx := 0; idx < values.Len(); idx++ {
 		elements.add(values.Get(idx))
 	}
+
+	for _, stmt := range fb.enumReservedStatements(enum) {
+		elements.addStatement(stmt)
+	}
+
 	return fb.printSection("enum", enum, elements)
 }
 
@@ -140,6 +165,10 @@ func (fb *fileBuilder) printService(svc protoreflect.ServiceDescriptor) error {
 }
 
 func (fb *fileBuilder) printMessage(msg protoreflect.MessageDescriptor) error {
+	return fb.printSection("message", msg, fb.messageElements(msg))
+}
+
+func (fb *fileBuilder) messageElements(msg protoreflect.MessageDescriptor) sourceElements {
 
 	elements := newElements()
 
@@ -162,12 +191,18 @@ func (fb *fileBuilder) printMessage(msg protoreflect.MessageDescriptor) error {
 		elements.add(oneof)
 	}
 
+	groups := groupMessages(msg.Fields(), msg.Extensions())
+
 	nestedMessages := msg.Messages()
 	for idx := 0; idx < nestedMessages.Len(); idx++ {
 		nested := nestedMessages.Get(idx)
 		if nested.IsMapEntry() {
 			continue
 		}
+		if _, ok := groups[nested.FullName()]; ok {
+			// printed in place of the group field
+			continue
+		}
 		elements.add(nested)
 	}
 
@@ -176,42 +211,83 @@ func (fb *fileBuilder) printMessage(msg protoreflect.MessageDescriptor) error {
 		elements.add(enums.Get(idx))
 	}
 
-	return fb.printSection("message", msg, elements)
+	// field 6 of DescriptorProto is extension
+	for _, block := range fb.extendBlocks(msg, msg.Extensions(), 6) {
+		elements.addExtension(block)
+	}
+
+	for _, stmt := range fb.extensionRangeStatements(msg) {
+		elements.addStatement(stmt)
+	}
+
+	for _, stmt := range fb.messageReservedStatements(msg) {
+		elements.addStatement(stmt)
+	}
+
+	return elements
+}
+
+// isGroup returns true when the field is a proto2 group, which is declared
+// along with its message type.
+func isGroup(field protoreflect.FieldDescriptor) bool {
+	return field.Kind() == protoreflect.GroupKind && field.Syntax() == protoreflect.Proto2
+}
+
+// groupMessages returns the names of message types which are declared by group
+// fields.
+func groupMessages(fieldLists ...interface {
+	Len() int
+	Get(int) protoreflect.FieldDescriptor
+}) map[protoreflect.FullName]struct{} {
+	groups := map[protoreflect.FullName]struct{}{}
+	for _, fields := range fieldLists {
+		for idx := 0; idx < fields.Len(); idx++ {
+			field := fields.Get(idx)
+			if isGroup(field) {
+				groups[field.Message().FullName()] = struct{}{}
+			}
+		}
+	}
+	return groups
 }
 
 func (ind *fileBuilder) printMethod(method protoreflect.MethodDescriptor) error {
 	svc := method.Parent()
 
-	inputType, err := contextRefName(svc, method.Input())
-	if err != nil {
-		return err
-	}
-	outputType, err := contextRefName(svc, method.Output())
-	if err != nil {
-		return err
-	}
+	inputType := ind.refName(svc, method.Input(), false)
+	outputType := ind.refName(svc, method.Output(), false)
 
-	extensions, err := ind.out.extensions.OptionsFor(method)
+	extensions, err := ind.optionsFor(method)
 	if err != nil {
 		return err
 	}
 
-	end := " {}"
-	if len(extensions) > 0 {
-		end = " {"
+	if method.IsStreamingClient() {
+		inputType = "stream " + inputType
+	}
+	if method.IsStreamingServer() {
+		outputType = "stream " + outputType
 	}
 
 	srcLoc := method.ParentFile().SourceLocations().ByDescriptor(method)
+
+	// As with blocks, the trailing comment follows the opening brace, so the
+	// body is only collapsed without one.
+	if len(extensions) == 0 && srcLoc.TrailingComments == "" {
+		ind.leadingComments(srcLoc)
+		ind.p("rpc ", method.Name(), "(", inputType, ") returns (", outputType, ") {}")
+		ind.addGap()
+		return nil
+	}
+
 	ind.leadingComments(srcLoc)
-	ind.p("rpc ", method.Name(), "(", inputType, ") returns (", outputType, ")", end, inlineComment(srcLoc))
-	ind.trailingComments(srcLoc)
+	ind.p("rpc ", method.Name(), "(", inputType, ") returns (", outputType, ") {", inlineComment(srcLoc))
 	extInd := ind.indent()
-	if len(extensions) > 0 {
-		for _, ext := range extensions {
-			extInd.printOption(ext)
-		}
-		ind.endElem("}")
+	extInd.trailingComments(srcLoc)
+	for _, ext := range extensions {
+		extInd.printOption(ext)
 	}
+	ind.endElem("}")
 
 	ind.addGap()
 
@@ -224,17 +300,47 @@ func (fb *fileBuilder) printEnumValue(field protoreflect.EnumValueDescriptor) er
 }
 
 type extBlock struct {
-	extends protoreflect.FullName
-	fields  []protoreflect.FieldDescriptor
+	extends  protoreflect.FullName
+	fields   []protoreflect.FieldDescriptor
+	location protoreflect.SourceLocation
+}
+
+// extendBlocks groups extensions by the 'extend' block they were declared in,
+// or, without source info, by consecutive extensions of the same message.
+func (fb *fileBuilder) extendBlocks(parent protoreflect.Descriptor, exts protoreflect.ExtensionDescriptors, fieldNumber int32) []*extBlock {
+	blocks := make([]*extBlock, 0)
+	for _, group := range fb.groupByStatement(parent, fieldNumber, exts.Len()) {
+		var block *extBlock
+		for _, idx := range group.indexes {
+			ext := exts.Get(idx)
+			fullName := ext.ContainingMessage().FullName()
+			if block == nil || block.extends != fullName {
+				block = &extBlock{
+					extends:  fullName,
+					location: group.location,
+				}
+				blocks = append(blocks, block)
+			}
+			block.fields = append(block.fields, ext)
+		}
+	}
+	return blocks
 }
 
 func (ind *fileBuilder) printExtension(block extBlock) error {
-	ind.p("extend ", block.extends, " {")
+	extendee := ind.refName(block.fields[0].Parent(), block.fields[0].ContainingMessage(), false)
+
+	ind.leadingComments(block.location)
+	ind.p("extend ", extendee, " {", inlineComment(block.location))
 	ind2 := ind.indent()
+	ind2.trailingComments(block.location)
+
+	elements := newElements()
 	for _, extField := range block.fields {
-		if err := ind2.printField(extField); err != nil {
-			return err
-		}
+		elements.add(extField)
+	}
+	if err := ind2.printElements(elements); err != nil {
+		return err
 	}
 	ind.endElem("}")
 	ind.addGap()
@@ -249,29 +355,61 @@ func (ind *fileBuilder) printField(field protoreflect.FieldDescriptor) error {
 	var label string
 
 	if field.IsMap() {
-		keyTypeName, err := fieldTypeName(field.MapKey())
+		keyTypeName, err := ind.fieldTypeName(field.MapKey())
 		if err != nil {
 			return err
 		}
-		valueTypeName, err := fieldTypeName(field.MapValue())
+		valueTypeName, err := ind.fieldTypeName(field.MapValue())
 		if err != nil {
 			return err
 		}
 		typeName = fmt.Sprintf("map<%s, %s>", keyTypeName, valueTypeName)
 	} else {
-		typeName, err = fieldTypeName(field)
+		typeName, err = ind.fieldTypeName(field)
 		if err != nil {
 			return err
 		}
 
 		if field.IsList() {
 			label = "repeated "
+		} else if field.Cardinality() == protoreflect.Required && field.Syntax() == protoreflect.Proto2 {
+			label = "required "
 		} else if field.HasOptionalKeyword() {
 			label = "optional "
 		}
 	}
+
+	if isGroup(field) {
+		return ind.printGroup(label, field)
+	}
+
 	fieldKey := fmt.Sprintf("%s%s %s", label, typeName, field.Name())
 
 	return ind.printFieldStyle(fieldKey, int32(field.Number()), field)
 
 }
+
+// printGroup prints a proto2 group field, which declares a message type inline
+// with the field.
+func (ind *fileBuilder) printGroup(label string, field protoreflect.FieldDescriptor) error {
+	options, err := ind.fieldOptions(field)
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("%sgroup %s = %d", label, field.Message().Name(), field.Number())
+	if len(options) > 0 {
+		parts := make([]string, 0, len(options))
+		for _, opt := range options {
+			if opt.inlineString == nil {
+				return fmt.Errorf("group %s option %s cannot be printed inline", field.FullName(), opt.qualifiedName)
+			}
+			parts = append(parts, fmt.Sprintf("%s = %s", opt.qualifiedName, *opt.inlineString))
+		}
+		header = fmt.Sprintf("%s [%s]", header, strings.Join(parts, ", "))
+	}
+
+	// The comments for a group are attached to the message, which is printed
+	// as a block in place of the field.
+	return ind.printBlock(header, field.Message(), ind.messageElements(field.Message()))
+}
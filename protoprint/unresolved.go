@@ -0,0 +1,211 @@
+package protoprint
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pentops/prototools/optionreflect"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// unresolvedOptions splits an option which could not be decoded into one
+// option for each statement which set it, to be printed from the source. When
+// the source isn't available the option is dropped.
+func (fb *fileBuilder) unresolvedOptions(thing protoreflect.Descriptor, opt *optionreflect.OptionDefinition) []*optionreflect.OptionDefinition {
+	number := opt.Unresolved.Number
+	warning := Warning{
+		Filename: thing.ParentFile().Path(),
+		Element:  thing.FullName(),
+	}
+
+	if len(opt.Unresolved.Locations) == 0 || fb.out.printer.source(thing.ParentFile().Path()) == nil {
+		warning.Message = fmt.Sprintf("extension %d is not known and the source is not available, the option is dropped", number)
+		fb.out.warn(warning)
+		return nil
+	}
+
+	warning.Message = fmt.Sprintf("extension %d is not known, the option is printed from source", number)
+	fb.out.warn(warning)
+
+	out := make([]*optionreflect.OptionDefinition, 0, len(opt.Unresolved.Locations))
+	for _, loc := range opt.Unresolved.Locations {
+		if fb.unresolvedSource(opt.Context, number, loc.Span) == nil {
+			warning.Message = fmt.Sprintf("extension %d is not known and the source does not match the descriptor, the option is dropped", number)
+			fb.out.warn(warning)
+			continue
+		}
+
+		unresolved := *opt.Unresolved
+		unresolved.Locations = []*descriptorpb.SourceCodeInfo_Location{loc}
+
+		startLine, _, endLine, _ := spanPositions(loc.Span)
+		singleLine := startLine == endLine
+		var parentLocation protoreflect.SourceLocation
+		if opt.SourceLocation != nil {
+			parentLocation = opt.SourceLocation.Parent
+		}
+
+		out = append(out, &optionreflect.OptionDefinition{
+			Context:    opt.Context,
+			Unresolved: &unresolved,
+			SourceLocation: &optionreflect.OptionSourceLocation{
+				InLineWithParent: singleLine && parentLocation.StartLine == int(startLine),
+				SingleLine:       singleLine,
+				StartLine:        startLine,
+				Src:              loc,
+				Parent:           parentLocation,
+			},
+		})
+	}
+	return out
+}
+
+// parseUnresolved parses the option from the source text of its statement,
+// either `option name = value;` or, for fields, `name = value`.
+func (fb *fileBuilder) parseUnresolved(opt *optionreflect.OptionDefinition) parsedOption {
+	loc := opt.Unresolved.Locations[0]
+	lines := fb.sourceText(opt.Context.ParentFile().Path(), loc.Span)
+
+	text := strings.Join(lines, "\n")
+	text = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), ";"))
+	if after, ok := strings.CutPrefix(text, "option"); ok && strings.HasPrefix(strings.TrimSpace(after), "(") {
+		text = strings.TrimSpace(after)
+	}
+
+	name, value, _ := strings.Cut(text, "=")
+	valueLines := strings.Split(strings.TrimSpace(value), "\n")
+
+	parsed := parsedOption{
+		def:           opt,
+		inline:        opt.SourceLocation.InLineWithParent,
+		qualifiedName: strings.TrimSpace(name),
+		comments:      optionComments(opt),
+		span:          optionSpan(opt),
+	}
+	if len(valueLines) == 1 {
+		parsed.inlineString = proto.String(valueLines[0])
+	} else {
+		parsed.rawValue = valueLines
+	}
+	return parsed
+}
+
+// unresolvedSource returns the source text at the span when it is a statement,
+// or an entry in a field's option list, which sets the extension. It is nil
+// when the source is not what the descriptor was compiled from.
+func (fb *fileBuilder) unresolvedSource(context protoreflect.Descriptor, number protoreflect.FieldNumber, span []int32) []string {
+	lines := fb.sourceText(context.ParentFile().Path(), span)
+	if lines == nil {
+		return nil
+	}
+	name, ok := optionStatementName(strings.Join(lines, "\n"))
+	if !ok {
+		return nil
+	}
+
+	// The extension itself is not known, but a name which resolves to
+	// anything other than an extension with the number is some other option.
+	res := fb.out.printer.resolver(optionScope(context), false)
+	var found symbol
+	if full, ok := strings.CutPrefix(name, "."); ok {
+		found = res.lookup(res.files, full)
+	} else {
+		found = res.resolve(name)
+	}
+	if found.desc != nil {
+		ext, ok := found.desc.(protoreflect.ExtensionDescriptor)
+		if !ok || ext.Number() != number {
+			return nil
+		}
+	}
+	return lines
+}
+
+// optionStatementName returns the extension name of `option (name).path =
+// value;`, or of `(name).path = value` in a field's option list.
+func optionStatementName(text string) (string, bool) {
+	text = strings.TrimSpace(text)
+	if after, ok := strings.CutPrefix(text, "option"); ok {
+		text = strings.TrimSpace(after)
+	}
+	inner, ok := strings.CutPrefix(text, "(")
+	if !ok {
+		return "", false
+	}
+	name, rest, ok := strings.Cut(inner, ")")
+	if !ok {
+		return "", false
+	}
+	name = strings.TrimSpace(name)
+	rest = strings.TrimSpace(rest)
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return "", false
+	}
+	if !strings.HasPrefix(rest, "=") && !strings.HasPrefix(rest, ".") {
+		return "", false
+	}
+	_, value, ok := strings.Cut(rest, "=")
+	if !ok || strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(value), ";")) == "" {
+		return "", false
+	}
+	return name, true
+}
+
+// sourceText returns the lines of the file covered by the span, with the
+// indent of the first line removed from all lines.
+func (fb *fileBuilder) sourceText(filename string, span []int32) []string {
+	source := fb.out.printer.source(filename)
+	startLine, startCol, endLine, endCol := spanPositions(span)
+	if int(endLine) >= len(source) {
+		return nil
+	}
+
+	firstLine := source[startLine]
+	indent := firstLine[:len(firstLine)-len(strings.TrimLeft(firstLine, " \t"))]
+
+	out := make([]string, 0, endLine-startLine+1)
+	for lineNum := startLine; lineNum <= endLine; lineNum++ {
+		line := source[lineNum]
+		start, end := 0, len(line)
+		if lineNum == startLine {
+			start = columnOffset(line, int(startCol))
+		}
+		if lineNum == endLine {
+			end = columnOffset(line, int(endCol))
+		}
+		text := line[start:end]
+		if lineNum != startLine {
+			text = strings.TrimPrefix(text, indent)
+		}
+		out = append(out, text)
+	}
+	return out
+}
+
+// spanPositions expands a source span, which omits the end line when it is
+// the same as the start line.
+func spanPositions(span []int32) (startLine, startCol, endLine, endCol int32) {
+	if len(span) == 3 {
+		return span[0], span[1], span[0], span[2]
+	}
+	return span[0], span[1], span[2], span[3]
+}
+
+// columnOffset converts a column of a source span to a byte offset in the
+// line. Columns count runes, with tabs advancing to the next multiple of 8.
+func columnOffset(line string, column int) int {
+	col := 0
+	for offset, r := range line {
+		if col >= column {
+			return offset
+		}
+		if r == '\t' {
+			col += 8 - (col % 8)
+		} else {
+			col++
+		}
+	}
+	return len(line)
+}
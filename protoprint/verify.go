@@ -0,0 +1,613 @@
+package protoprint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/bufbuild/protocompile"
+	"github.com/pentops/prototools/optionreflect"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// VerifyError lists the differences between a file and its printed output.
+type VerifyError struct {
+	Filename string
+	Diffs    []string
+}
+
+func (ve *VerifyError) Error() string {
+	return fmt.Sprintf("printed %s does not match the original:\n  %s", ve.Filename, strings.Join(ve.Diffs, "\n  "))
+}
+
+// Verify compiles the printed source of the file, and checks that it describes
+// the same file as the original. Source info is ignored, as are differences
+// which printing is allowed to make: import order, merging contiguous ranges,
+// the order of options, default json names, and features set where they
+// would be inherited anyway.
+func Verify(ctx context.Context, original protoreflect.FileDescriptor, printed []byte) error {
+	imports := map[string]protoreflect.FileDescriptor{}
+	var walk func(file protoreflect.FileDescriptor)
+	walk = func(file protoreflect.FileDescriptor) {
+		fileImports := file.Imports()
+		for idx := 0; idx < fileImports.Len(); idx++ {
+			imported := fileImports.Get(idx).FileDescriptor
+			if _, ok := imports[imported.Path()]; ok {
+				continue
+			}
+			imports[imported.Path()] = imported
+			walk(imported)
+		}
+	}
+	walk(original)
+
+	resolver := protocompile.ResolverFunc(func(filename string) (protocompile.SearchResult, error) {
+		if filename == original.Path() {
+			return protocompile.SearchResult{
+				Source: bytes.NewReader(printed),
+			}, nil
+		}
+		if imported, ok := imports[filename]; ok {
+			return protocompile.SearchResult{
+				Desc: imported,
+			}, nil
+		}
+		return protocompile.SearchResult{}, fmt.Errorf("import %s not found", filename)
+	})
+
+	compiler := protocompile.Compiler{
+		Resolver: protocompile.WithStandardImports(resolver),
+	}
+	compiled, err := compiler.Compile(ctx, original.Path())
+	if err != nil {
+		return fmt.Errorf("compiling printed %s: %w", original.Path(), err)
+	}
+	recompiled := compiled[0]
+
+	diffs, err := featureDiffs(original, recompiled)
+	if err != nil {
+		return err
+	}
+
+	// Both sides decode options with the original's extensions, so that
+	// option values are compared field by field.
+	extensions := extensionBuilder([]protoreflect.FileDescriptor{original}, nil)
+	want, err := normalizedFile(original, extensions)
+	if err != nil {
+		return err
+	}
+	got, err := normalizedFile(recompiled, extensions)
+	if err != nil {
+		return err
+	}
+
+	diffs = append(diffs, diffMessages("", want.ProtoReflect(), got.ProtoReflect())...)
+	if len(diffs) > 0 {
+		return &VerifyError{
+			Filename: original.Path(),
+			Diffs:    diffs,
+		}
+	}
+	return nil
+}
+
+// featureDiffs compares the resolved features of every descriptor in the
+// files, which is what matters rather than where each feature was set.
+func featureDiffs(want, got protoreflect.FileDescriptor) ([]string, error) {
+	wantFeatures, err := allResolvedFeatures(want)
+	if err != nil {
+		return nil, err
+	}
+	gotFeatures, err := allResolvedFeatures(got)
+	if err != nil {
+		return nil, err
+	}
+
+	diffs := make([]string, 0)
+	for _, name := range sortedKeys(wantFeatures) {
+		gotFeature, ok := gotFeatures[name]
+		if !ok {
+			// reported by the descriptor comparison
+			continue
+		}
+		for _, diff := range diffMessages("", wantFeatures[name].ProtoReflect(), gotFeature.ProtoReflect()) {
+			diffs = append(diffs, fmt.Sprintf("features of %s: %s", name, diff))
+		}
+	}
+	return diffs, nil
+}
+
+func allResolvedFeatures(file protoreflect.FileDescriptor) (map[string]*descriptorpb.FeatureSet, error) {
+	features := map[string]*descriptorpb.FeatureSet{}
+
+	add := func(desc protoreflect.Descriptor) error {
+		resolved, err := optionreflect.ResolvedFeatures(desc)
+		if err != nil {
+			return err
+		}
+		name := string(desc.FullName())
+		if _, ok := desc.(protoreflect.FileDescriptor); ok {
+			name = file.Path()
+		}
+		features[name] = resolved
+		return nil
+	}
+
+	if err := add(file); err != nil {
+		return nil, err
+	}
+	var walkErr error
+	walkDescriptors(file, func(desc protoreflect.Descriptor) {
+		if walkErr == nil {
+			walkErr = add(desc)
+		}
+	})
+	return features, walkErr
+}
+
+// walkDescriptors calls the callback for every descriptor declared in the
+// file, at any depth.
+func walkDescriptors(file protoreflect.FileDescriptor, callback func(protoreflect.Descriptor)) {
+	walkFields := func(fields protoreflect.ExtensionDescriptors) {
+		for idx := 0; idx < fields.Len(); idx++ {
+			callback(fields.Get(idx))
+		}
+	}
+
+	walkEnums := func(enums protoreflect.EnumDescriptors) {
+		for idx := 0; idx < enums.Len(); idx++ {
+			enum := enums.Get(idx)
+			callback(enum)
+			values := enum.Values()
+			for valueIdx := 0; valueIdx < values.Len(); valueIdx++ {
+				callback(values.Get(valueIdx))
+			}
+		}
+	}
+
+	var walkMessages func(messages protoreflect.MessageDescriptors)
+	walkMessages = func(messages protoreflect.MessageDescriptors) {
+		for idx := 0; idx < messages.Len(); idx++ {
+			msg := messages.Get(idx)
+			callback(msg)
+			fields := msg.Fields()
+			for fieldIdx := 0; fieldIdx < fields.Len(); fieldIdx++ {
+				callback(fields.Get(fieldIdx))
+			}
+			oneofs := msg.Oneofs()
+			for oneofIdx := 0; oneofIdx < oneofs.Len(); oneofIdx++ {
+				callback(oneofs.Get(oneofIdx))
+			}
+			walkFields(msg.Extensions())
+			walkEnums(msg.Enums())
+			walkMessages(msg.Messages())
+		}
+	}
+
+	walkMessages(file.Messages())
+	walkEnums(file.Enums())
+	walkFields(file.Extensions())
+
+	services := file.Services()
+	for idx := 0; idx < services.Len(); idx++ {
+		svc := services.Get(idx)
+		callback(svc)
+		methods := svc.Methods()
+		for methodIdx := 0; methodIdx < methods.Len(); methodIdx++ {
+			callback(methods.Get(methodIdx))
+		}
+	}
+}
+
+// normalizedFile converts the file to a descriptor proto with the differences
+// which printing is allowed to make removed.
+func normalizedFile(file protoreflect.FileDescriptor, extensions protoregistry.ExtensionTypeResolver) (*descriptorpb.FileDescriptorProto, error) {
+	// Round trip through the wire format with the given extensions, so that
+	// both sides hold the same extension types regardless of how each side
+	// was built. Extensions not in the resolver stay unknown fields.
+	raw, err := proto.MarshalOptions{Deterministic: true}.Marshal(protodesc.ToFileDescriptorProto(file))
+	if err != nil {
+		return nil, err
+	}
+	fdp := &descriptorpb.FileDescriptorProto{}
+	if err := (proto.UnmarshalOptions{Resolver: extensions}).Unmarshal(raw, fdp); err != nil {
+		return nil, err
+	}
+
+	fdp.SourceCodeInfo = nil
+	if fdp.Syntax == nil {
+		fdp.Syntax = proto.String("proto2")
+	}
+
+	normalizeDependencies(fdp)
+
+	for _, msg := range fdp.MessageType {
+		normalizeMessage(msg)
+	}
+	for _, enum := range fdp.EnumType {
+		normalizeEnum(enum)
+	}
+	for _, ext := range fdp.Extension {
+		normalizeField(ext)
+	}
+	normalizeOptions(fdp.ProtoReflect())
+
+	return fdp, nil
+}
+
+// normalizeDependencies sorts the imports, updating the public and weak
+// indexes to match.
+func normalizeDependencies(fdp *descriptorpb.FileDescriptorProto) {
+	public := map[string]bool{}
+	for _, idx := range fdp.PublicDependency {
+		public[fdp.Dependency[idx]] = true
+	}
+	weak := map[string]bool{}
+	for _, idx := range fdp.WeakDependency {
+		weak[fdp.Dependency[idx]] = true
+	}
+
+	sort.Strings(fdp.Dependency)
+
+	fdp.PublicDependency = nil
+	fdp.WeakDependency = nil
+	for idx, dep := range fdp.Dependency {
+		if public[dep] {
+			fdp.PublicDependency = append(fdp.PublicDependency, int32(idx))
+		}
+		if weak[dep] {
+			fdp.WeakDependency = append(fdp.WeakDependency, int32(idx))
+		}
+	}
+}
+
+func normalizeMessage(msg *descriptorpb.DescriptorProto) {
+	for _, field := range msg.Field {
+		normalizeField(field)
+	}
+	for _, ext := range msg.Extension {
+		normalizeField(ext)
+	}
+	for _, nested := range msg.NestedType {
+		normalizeMessage(nested)
+	}
+	for _, enum := range msg.EnumType {
+		normalizeEnum(enum)
+	}
+
+	// Message ranges are exclusive of the end
+	msg.ReservedRange = mergeRanges(msg.ReservedRange, 0,
+		func(rr *descriptorpb.DescriptorProto_ReservedRange) (int32, int32) { return rr.GetStart(), rr.GetEnd() },
+		func(rr *descriptorpb.DescriptorProto_ReservedRange, end int32) { rr.End = proto.Int32(end) },
+		func(a, b *descriptorpb.DescriptorProto_ReservedRange) bool { return true },
+	)
+	msg.ExtensionRange = mergeRanges(msg.ExtensionRange, 0,
+		func(rr *descriptorpb.DescriptorProto_ExtensionRange) (int32, int32) {
+			return rr.GetStart(), rr.GetEnd()
+		},
+		func(rr *descriptorpb.DescriptorProto_ExtensionRange, end int32) { rr.End = proto.Int32(end) },
+		func(a, b *descriptorpb.DescriptorProto_ExtensionRange) bool { return proto.Equal(a.Options, b.Options) },
+	)
+}
+
+func normalizeEnum(enum *descriptorpb.EnumDescriptorProto) {
+	// Enum ranges are inclusive of the end
+	enum.ReservedRange = mergeRanges(enum.ReservedRange, 1,
+		func(rr *descriptorpb.EnumDescriptorProto_EnumReservedRange) (int32, int32) {
+			return rr.GetStart(), rr.GetEnd()
+		},
+		func(rr *descriptorpb.EnumDescriptorProto_EnumReservedRange, end int32) { rr.End = proto.Int32(end) },
+		func(a, b *descriptorpb.EnumDescriptorProto_EnumReservedRange) bool { return true },
+	)
+}
+
+func normalizeField(field *descriptorpb.FieldDescriptorProto) {
+	if field.GetJsonName() == jsonCamelCase(field.GetName()) {
+		field.JsonName = nil
+	}
+}
+
+// mergeRanges sorts the ranges and merges those which are contiguous, where
+// the end of one plus the offset is the start of the next.
+func mergeRanges[T any](ranges []T, offset int32, bounds func(T) (int32, int32), setEnd func(T, int32), canMerge func(a, b T) bool) []T {
+	slices.SortStableFunc(ranges, func(a, b T) int {
+		aStart, _ := bounds(a)
+		bStart, _ := bounds(b)
+		return int(aStart) - int(bStart)
+	})
+
+	out := make([]T, 0, len(ranges))
+	for _, rr := range ranges {
+		if len(out) > 0 {
+			last := out[len(out)-1]
+			_, lastEnd := bounds(last)
+			start, end := bounds(rr)
+			if lastEnd+offset == start && canMerge(last, rr) {
+				setEnd(last, end)
+				continue
+			}
+		}
+		out = append(out, rr)
+	}
+	return out
+}
+
+// normalizeOptions walks the message, and for every options message drops the
+// features, which are compared after resolving, sorts the unknown fields,
+// being extensions the original doesn't declare or import, by number and drops
+// it entirely when empty.
+func normalizeOptions(msg protoreflect.Message) {
+	msg.Range(func(field protoreflect.FieldDescriptor, val protoreflect.Value) bool {
+		if field.Kind() != protoreflect.MessageKind {
+			return true
+		}
+
+		if field.IsList() {
+			list := val.List()
+			for idx := 0; idx < list.Len(); idx++ {
+				normalizeOptions(list.Get(idx).Message())
+			}
+			return true
+		}
+
+		if field.Name() != "options" {
+			normalizeOptions(val.Message())
+			return true
+		}
+
+		options := val.Message()
+		if featuresField := options.Descriptor().Fields().ByName("features"); featuresField != nil {
+			options.Clear(featuresField)
+		}
+		options.SetUnknown(sortUnknown(options.GetUnknown()))
+
+		if proto.Size(options.Interface()) == 0 {
+			msg.Clear(field)
+		}
+		return true
+	})
+}
+
+// sortUnknown sorts the fields of the raw message by number, keeping the order
+// of repeated fields.
+func sortUnknown(raw protoreflect.RawFields) protoreflect.RawFields {
+	type rawField struct {
+		number protowire.Number
+		data   []byte
+	}
+
+	fields := make([]rawField, 0)
+	for len(raw) > 0 {
+		number, _, n := protowire.ConsumeField(raw)
+		if n < 0 {
+			return raw
+		}
+		fields = append(fields, rawField{number: number, data: raw[:n]})
+		raw = raw[n:]
+	}
+
+	slices.SortStableFunc(fields, func(a, b rawField) int {
+		return int(a.number) - int(b.number)
+	})
+
+	var out protoreflect.RawFields
+	for _, field := range fields {
+		out = append(out, field.data...)
+	}
+	return out
+}
+
+// diffMessages returns the differences between the messages, each prefixed with
+// the path to the field, e.g. `message_type[Foo].field[bar].type`. Items in
+// lists are identified by name where they have one.
+func diffMessages(path string, want, got protoreflect.Message) []string {
+	diffs := make([]string, 0)
+
+	fields := make([]protoreflect.FieldDescriptor, 0)
+	descFields := want.Descriptor().Fields()
+	for idx := 0; idx < descFields.Len(); idx++ {
+		fields = append(fields, descFields.Get(idx))
+	}
+	fields = append(fields, setExtensions(want, got)...)
+
+	for _, field := range fields {
+		fieldPath := string(field.Name())
+		if field.IsExtension() {
+			fieldPath = fmt.Sprintf("(%s)", field.FullName())
+		}
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+
+		if !want.Has(field) && !got.Has(field) {
+			continue
+		}
+		if !want.Has(field) {
+			diffs = append(diffs, fmt.Sprintf("%s: not set in the original, printed %s", fieldPath, formatValue(field, got.Get(field))))
+			continue
+		}
+		if !got.Has(field) {
+			diffs = append(diffs, fmt.Sprintf("%s: %s in the original, not set in printed", fieldPath, formatValue(field, want.Get(field))))
+			continue
+		}
+
+		wantVal := want.Get(field)
+		gotVal := got.Get(field)
+
+		switch {
+		case field.IsList():
+			diffs = append(diffs, diffLists(fieldPath, field, wantVal.List(), gotVal.List())...)
+		case field.IsMap():
+			if !wantVal.Equal(gotVal) {
+				diffs = append(diffs, fmt.Sprintf("%s: maps differ", fieldPath))
+			}
+		case field.Kind() == protoreflect.MessageKind || field.Kind() == protoreflect.GroupKind:
+			diffs = append(diffs, diffMessages(fieldPath, wantVal.Message(), gotVal.Message())...)
+		default:
+			if !wantVal.Equal(gotVal) {
+				diffs = append(diffs, fmt.Sprintf("%s: %s in the original, printed %s", fieldPath, formatValue(field, wantVal), formatValue(field, gotVal)))
+			}
+		}
+	}
+
+	if !bytes.Equal(want.GetUnknown(), got.GetUnknown()) {
+		// only extensions which the original file doesn't know about
+		unknownPath := "extensions"
+		if path != "" {
+			unknownPath = path + "." + unknownPath
+		}
+		diffs = append(diffs, fmt.Sprintf("%s: unknown option values differ", unknownPath))
+	}
+
+	return diffs
+}
+
+// setExtensions returns the extensions set on either message, by number.
+func setExtensions(want, got protoreflect.Message) []protoreflect.FieldDescriptor {
+	byNumber := map[protoreflect.FieldNumber]protoreflect.FieldDescriptor{}
+	collect := func(field protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		if field.IsExtension() {
+			byNumber[field.Number()] = field
+		}
+		return true
+	}
+	want.Range(collect)
+	got.Range(collect)
+
+	exts := make([]protoreflect.FieldDescriptor, 0, len(byNumber))
+	for _, field := range byNumber {
+		exts = append(exts, field)
+	}
+	slices.SortFunc(exts, func(a, b protoreflect.FieldDescriptor) int {
+		return int(a.Number()) - int(b.Number())
+	})
+	return exts
+}
+
+func diffLists(path string, field protoreflect.FieldDescriptor, want, got protoreflect.List) []string {
+	if field.Kind() != protoreflect.MessageKind {
+		if !listsEqual(want, got) {
+			return []string{fmt.Sprintf("%s: %s in the original, printed %s", path, formatList(field, want), formatList(field, got))}
+		}
+		return nil
+	}
+
+	wantNames, wantNamed := listNames(want)
+	gotNames, gotNamed := listNames(got)
+	if !wantNamed || !gotNamed {
+		diffs := make([]string, 0)
+		for idx := 0; idx < want.Len() && idx < got.Len(); idx++ {
+			diffs = append(diffs, diffMessages(fmt.Sprintf("%s[%d]", path, idx), want.Get(idx).Message(), got.Get(idx).Message())...)
+		}
+		if want.Len() != got.Len() {
+			diffs = append(diffs, fmt.Sprintf("%s: %d items in the original, printed %d", path, want.Len(), got.Len()))
+		}
+		return diffs
+	}
+
+	diffs := make([]string, 0)
+	for idx := 0; idx < want.Len(); idx++ {
+		name := wantNames[idx]
+		itemPath := fmt.Sprintf("%s[%s]", path, name)
+		gotIdx := slices.Index(gotNames, name)
+		if gotIdx < 0 {
+			diffs = append(diffs, fmt.Sprintf("%s: missing from printed", itemPath))
+			continue
+		}
+		diffs = append(diffs, diffMessages(itemPath, want.Get(idx).Message(), got.Get(gotIdx).Message())...)
+	}
+	for _, name := range gotNames {
+		if !slices.Contains(wantNames, name) {
+			diffs = append(diffs, fmt.Sprintf("%s[%s]: not in the original", path, name))
+		}
+	}
+
+	// Declaration order sets the index of each descriptor, and the order of
+	// generated code.
+	wantOrder := slices.DeleteFunc(slices.Clone(wantNames), func(name string) bool { return !slices.Contains(gotNames, name) })
+	gotOrder := slices.DeleteFunc(slices.Clone(gotNames), func(name string) bool { return !slices.Contains(wantNames, name) })
+	if !slices.Equal(wantOrder, gotOrder) {
+		diffs = append(diffs, fmt.Sprintf("%s: order is [%s] in the original, printed [%s]", path, strings.Join(wantOrder, ", "), strings.Join(gotOrder, ", ")))
+	}
+	return diffs
+}
+
+// listNames returns the name of each message in the list, if all have a
+// unique name.
+func listNames(list protoreflect.List) ([]string, bool) {
+	names := make([]string, 0, list.Len())
+	for idx := 0; idx < list.Len(); idx++ {
+		msg := list.Get(idx).Message()
+		nameField := msg.Descriptor().Fields().ByName("name")
+		if nameField == nil || nameField.Kind() != protoreflect.StringKind || !msg.Has(nameField) {
+			return nil, false
+		}
+		name := msg.Get(nameField).String()
+		if slices.Contains(names, name) {
+			return nil, false
+		}
+		names = append(names, name)
+	}
+	return names, true
+}
+
+func listsEqual(want, got protoreflect.List) bool {
+	if want.Len() != got.Len() {
+		return false
+	}
+	for idx := 0; idx < want.Len(); idx++ {
+		if !want.Get(idx).Equal(got.Get(idx)) {
+			return false
+		}
+	}
+	return true
+}
+
+func formatList(field protoreflect.FieldDescriptor, list protoreflect.List) string {
+	items := make([]string, 0, list.Len())
+	for idx := 0; idx < list.Len(); idx++ {
+		items = append(items, formatItem(field, list.Get(idx)))
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
+
+func formatValue(field protoreflect.FieldDescriptor, val protoreflect.Value) string {
+	if field.IsList() {
+		return formatList(field, val.List())
+	}
+	return formatItem(field, val)
+}
+
+// formatItem formats a single value, or an item of a list.
+func formatItem(field protoreflect.FieldDescriptor, val protoreflect.Value) string {
+	switch field.Kind() {
+	case protoreflect.EnumKind:
+		if enumValue := field.Enum().Values().ByNumber(val.Enum()); enumValue != nil {
+			return string(enumValue.Name())
+		}
+		return fmt.Sprint(val.Enum())
+	case protoreflect.StringKind:
+		return optionreflect.QuoteString(val.String())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return "{...}"
+	default:
+		return fmt.Sprint(val.Interface())
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
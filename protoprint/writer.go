@@ -0,0 +1,384 @@
+package protoprint
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirWriter is a FileWriter which writes files under a root directory,
+// creating parent directories as required.
+//
+// Files which already hold the data are left alone. Others are written to a
+// temporary file in the same directory which is then renamed over the
+// original, so a file is never seen half written.
+type DirWriter struct {
+	root string
+
+	mu      sync.Mutex
+	changed []string
+}
+
+func NewDirWriter(root string) *DirWriter {
+	return &DirWriter{
+		root: root,
+	}
+}
+
+func (dw *DirWriter) PutFile(ctx context.Context, filename string, data []byte) error {
+	if err := validPath(filename); err != nil {
+		return err
+	}
+	fullPath := filepath.Join(dw.root, filepath.FromSlash(filename))
+
+	// Existing files keep their permissions
+	mode := os.FileMode(0644)
+	if stat, err := os.Stat(fullPath); err == nil {
+		mode = stat.Mode().Perm()
+		existing, err := os.ReadFile(fullPath)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(existing, data) {
+			return nil
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return err
+	}
+	if err := writeAtomic(fullPath, data, mode); err != nil {
+		return err
+	}
+
+	dw.mu.Lock()
+	dw.changed = append(dw.changed, filename)
+	dw.mu.Unlock()
+	return nil
+}
+
+// Changed returns the files which were written because they were new or
+// differed, in the order they were written.
+func (dw *DirWriter) Changed() []string {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	return append([]string(nil), dw.changed...)
+}
+
+func writeAtomic(fullPath string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), "."+filepath.Base(fullPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, fullPath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// validPath rejects filenames which are not clean, slash separated paths
+// within the root, e.g. `../x` or `/x`, so that no writer puts a file outside
+// of where it was pointed. Backslashes are rejected too, as some archive
+// readers take them as separators.
+func validPath(filename string) error {
+	if !fs.ValidPath(filename) || filename == "." || strings.Contains(filename, `\`) {
+		return &fs.PathError{Op: "put", Path: filename, Err: fs.ErrInvalid}
+	}
+	return nil
+}
+
+// MemoryFS is a FileWriter which keeps the files in memory. It is also an
+// fs.FS of the files written so far, so printed files can be read back, e.g.
+// by protosrc.ReadImageFromSourceDir along with a buf.yaml put alongside.
+type MemoryFS struct {
+	mu    sync.RWMutex
+	files map[string]*memoryFile
+}
+
+var _ fs.ReadFileFS = &MemoryFS{}
+
+// memoryFile is a file put in a MemoryFS. Files are replaced rather than
+// changed, so an open file keeps what it read.
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryFS() *MemoryFS {
+	return &MemoryFS{
+		files: map[string]*memoryFile{},
+	}
+}
+
+func (mf *MemoryFS) PutFile(ctx context.Context, filename string, data []byte) error {
+	if err := validPath(filename); err != nil {
+		return err
+	}
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	mf.files[filename] = &memoryFile{
+		data:    bytes.Clone(data),
+		modTime: time.Now(),
+	}
+	return nil
+}
+
+// Open opens a file, or a directory which holds files. Directories are not
+// stored, they are implied by the paths of the files.
+func (mf *MemoryFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+
+	if file, ok := mf.files[name]; ok {
+		return &openMemoryFile{
+			info:   file.info(path.Base(name)),
+			Reader: bytes.NewReader(file.data),
+		}, nil
+	}
+
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+	entries := map[string]fs.DirEntry{}
+	for filename, file := range mf.files {
+		rest, ok := strings.CutPrefix(filename, prefix)
+		if !ok {
+			continue
+		}
+		if child, _, isDir := strings.Cut(rest, "/"); isDir {
+			entries[child] = memoryDirInfo(child)
+		} else {
+			entries[child] = file.info(child)
+		}
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	dir := &openMemoryDir{
+		info:    memoryDirInfo(path.Base(name)),
+		entries: make([]fs.DirEntry, 0, len(entries)),
+	}
+	for _, entry := range entries {
+		dir.entries = append(dir.entries, entry)
+	}
+	sort.Slice(dir.entries, func(a, b int) bool {
+		return dir.entries[a].Name() < dir.entries[b].Name()
+	})
+	return dir, nil
+}
+
+func (mf *MemoryFS) ReadFile(name string) ([]byte, error) {
+	mf.mu.RLock()
+	file, ok := mf.files[name]
+	mf.mu.RUnlock()
+	if !ok {
+		// Open reports the name as invalid or missing, or the read fails
+		// for a directory.
+		f, err := mf.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	return bytes.Clone(file.data), nil
+}
+
+// Filenames returns the paths of the files written, sorted.
+func (mf *MemoryFS) Filenames() []string {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	names := make([]string, 0, len(mf.files))
+	for name := range mf.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (file *memoryFile) info(name string) *memoryFileInfo {
+	return &memoryFileInfo{
+		name:    name,
+		size:    int64(len(file.data)),
+		mode:    0644,
+		modTime: file.modTime,
+	}
+}
+
+func memoryDirInfo(name string) *memoryFileInfo {
+	return &memoryFileInfo{
+		name: name,
+		mode: fs.ModeDir | 0755,
+	}
+}
+
+// memoryFileInfo is both the FileInfo and the DirEntry of a file or directory
+// in a MemoryFS.
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *memoryFileInfo) Name() string               { return fi.name }
+func (fi *memoryFileInfo) Size() int64                { return fi.size }
+func (fi *memoryFileInfo) Mode() fs.FileMode          { return fi.mode }
+func (fi *memoryFileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi *memoryFileInfo) IsDir() bool                { return fi.mode.IsDir() }
+func (fi *memoryFileInfo) Sys() any                   { return nil }
+func (fi *memoryFileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi *memoryFileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+type openMemoryFile struct {
+	info *memoryFileInfo
+	*bytes.Reader
+}
+
+func (f *openMemoryFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *openMemoryFile) Close() error               { return nil }
+
+type openMemoryDir struct {
+	info    *memoryFileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openMemoryDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *openMemoryDir) Close() error               { return nil }
+
+func (d *openMemoryDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir returns the next n entries, or all that remain when n <= 0, as
+// fs.ReadDirFile describes.
+func (d *openMemoryDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(remaining))
+	d.offset += n
+	return remaining[:n], nil
+}
+
+// archiveTime is the modification time of files in archives, fixed so that
+// the same files give the same archive.
+var archiveTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// ZipWriter is a FileWriter which writes the files to a zip archive. Close
+// must be called to finish the archive.
+type ZipWriter struct {
+	mu sync.Mutex
+	zw *zip.Writer
+}
+
+func NewZipWriter(w io.Writer) *ZipWriter {
+	return &ZipWriter{
+		zw: zip.NewWriter(w),
+	}
+}
+
+func (zw *ZipWriter) PutFile(ctx context.Context, filename string, data []byte) error {
+	if err := validPath(filename); err != nil {
+		return err
+	}
+	zw.mu.Lock()
+	defer zw.mu.Unlock()
+	header := &zip.FileHeader{
+		Name:     filename,
+		Method:   zip.Deflate,
+		Modified: archiveTime,
+	}
+	header.SetMode(0644)
+	w, err := zw.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Close finishes the archive, it does not close the underlying writer.
+func (zw *ZipWriter) Close() error {
+	zw.mu.Lock()
+	defer zw.mu.Unlock()
+	return zw.zw.Close()
+}
+
+// TarGzWriter is a FileWriter which writes the files to a gzipped tar
+// archive. Close must be called to finish the archive.
+type TarGzWriter struct {
+	mu sync.Mutex
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func NewTarGzWriter(w io.Writer) *TarGzWriter {
+	gz := gzip.NewWriter(w)
+	return &TarGzWriter{
+		gz: gz,
+		tw: tar.NewWriter(gz),
+	}
+}
+
+func (tw *TarGzWriter) PutFile(ctx context.Context, filename string, data []byte) error {
+	if err := validPath(filename); err != nil {
+		return err
+	}
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if err := tw.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filename,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  archiveTime,
+	}); err != nil {
+		return err
+	}
+	_, err := tw.tw.Write(data)
+	return err
+}
+
+// Close finishes the archive, it does not close the underlying writer.
+func (tw *TarGzWriter) Close() error {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	return errors.Join(tw.tw.Close(), tw.gz.Close())
+}
@@ -0,0 +1,243 @@
+package protoprint
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/pentops/prototools/protosrc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirWriter(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	unchanged := filepath.Join(dir, "test", "v1", "same.proto")
+	if err := os.MkdirAll(filepath.Dir(unchanged), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(unchanged, []byte("same"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(unchanged, past, past); err != nil {
+		t.Fatal(err)
+	}
+	existing := filepath.Join(dir, "test", "v1", "existing.proto")
+	if err := os.WriteFile(existing, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := NewDirWriter(dir)
+	for name, data := range map[string]string{
+		"test/v1/same.proto":     "same",
+		"test/v1/existing.proto": "new",
+	} {
+		if err := writer.PutFile(ctx, name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.PutFile(ctx, "test/v2/created.proto", []byte("created")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.ElementsMatch(t, []string{"test/v1/existing.proto", "test/v2/created.proto"}, writer.Changed())
+
+	stat, err := os.Stat(unchanged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, past, stat.ModTime(), "unchanged file was written")
+
+	data, err := os.ReadFile(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "new", string(data))
+	stat, err = os.Stat(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+
+	stat, err = os.Stat(filepath.Join(dir, "test", "v2", "created.proto"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0644), stat.Mode().Perm())
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Join(dir, "test", "v1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, entries, 2)
+}
+
+func TestMemoryFS(t *testing.T) {
+	ctx := context.Background()
+	source := `syntax = "proto3";
+
+package test.v1;
+
+message Foo {
+  string name = 1;
+}
+`
+	module := NewMemoryFS()
+	if err := module.PutFile(ctx, "buf.lock", []byte("version: v1\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := module.PutFile(ctx, "test/v1/test.proto", []byte(source)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(module, "buf.lock", "test/v1/test.proto"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The printed files can be read back in as a module.
+	descriptors, err := protosrc.ReadImageFromSourceDir(ctx, module, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed := NewMemoryFS()
+	if err := PrintReflect(ctx, printed, descriptors, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"test/v1/test.proto"}, printed.Filenames())
+
+	data, err := printed.ReadFile("test/v1/test.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, source, string(data))
+
+	_, err = printed.ReadFile("test/v1/missing.proto")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = printed.ReadFile("test/v1")
+	assert.Error(t, err)
+
+	err = printed.PutFile(ctx, "../outside.proto", nil)
+	assert.ErrorIs(t, err, os.ErrInvalid)
+}
+
+func TestArchiveWriters(t *testing.T) {
+	ctx := context.Background()
+	files := []string{"a/a.proto", "b/b.proto"}
+
+	write := func(t *testing.T, writer interface {
+		FileWriter
+		io.Closer
+	}) {
+		for _, name := range files {
+			if err := writer.PutFile(ctx, name, []byte("content of "+name)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("zip", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		write(t, NewZipWriter(buf))
+
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, file := range zr.File {
+			rc, err := file.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "content of "+file.Name, string(data))
+			got = append(got, file.Name)
+		}
+		assert.Equal(t, files, got)
+
+		again := &bytes.Buffer{}
+		write(t, NewZipWriter(again))
+		assert.Equal(t, buf.Bytes(), again.Bytes(), "archive is not deterministic")
+	})
+
+	t.Run("tar.gz", func(t *testing.T) {
+		buf := &bytes.Buffer{}
+		write(t, NewTarGzWriter(buf))
+
+		gz, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		got := []string{}
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "content of "+header.Name, string(data))
+			got = append(got, header.Name)
+		}
+		assert.Equal(t, files, got)
+
+		again := &bytes.Buffer{}
+		write(t, NewTarGzWriter(again))
+		assert.Equal(t, buf.Bytes(), again.Bytes(), "archive is not deterministic")
+	})
+}
+
+func TestWriterInvalidPaths(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+
+	for name, writer := range map[string]FileWriter{
+		"dir":    NewDirWriter(root),
+		"memory": NewMemoryFS(),
+		"zip":    NewZipWriter(io.Discard),
+		"tar.gz": NewTarGzWriter(io.Discard),
+	} {
+		t.Run(name, func(t *testing.T) {
+			for _, filename := range []string{
+				"../outside.proto",
+				"a/../../outside.proto",
+				"/abs.proto",
+				"./a.proto",
+				`..\outside.proto`,
+				"",
+			} {
+				err := writer.PutFile(ctx, filename, []byte("data"))
+				assert.ErrorIs(t, err, os.ErrInvalid, filename)
+			}
+		})
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "outside.proto")); !os.IsNotExist(err) {
+		t.Errorf("expected no file outside the root, got %v", err)
+	}
+}
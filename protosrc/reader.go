@@ -71,7 +71,7 @@ func ReadImageFromSourceDir(ctx context.Context, rootFS fs.FS, subPath string) (
 
 	compiler := protocompile.Compiler{
 		Resolver:       protocompile.WithStandardImports(resolver),
-		SourceInfoMode: protocompile.SourceInfoExtraComments,
+		SourceInfoMode: protocompile.SourceInfoExtraComments | protocompile.SourceInfoExtraOptionLocations,
 	}
 
 	desc, err := compiler.Compile(ctx, filenames...)